@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 
 	"github.com/porthos-rpc/porthos-go"
@@ -53,6 +54,10 @@ func doSomethingWithEmptyResponse(req porthos.Request, res porthos.Response) {
 	res.Empty(porthos.StatusOK)
 }
 
+func addOne(ctx context.Context, in *input) (*output, error) {
+	return &output{in.Value, in.Value + 1}, nil
+}
+
 func main() {
 	b, err := porthos.NewBroker(os.Getenv("AMQP_URL"))
 	defer b.Close()
@@ -131,5 +136,10 @@ func main() {
 		},
 	})
 
+	// procedure as a plain function, its spec is derived from input and output.
+	if err := userService.RegisterFunc("addOne", addOne); err != nil {
+		panic(err)
+	}
+
 	userService.ListenAndServe()
 }
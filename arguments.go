@@ -3,6 +3,7 @@ package porthos
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 )
 
 // Argument represents an RPC method arument.
@@ -46,27 +47,27 @@ func (a *argument) AsString() (string, error) {
 }
 
 func (a *argument) AsInt() (int, error) {
-	i, err := a.value.(json.Number).Int64()
+	i, err := a.number().Int64()
 	return int(i), err
 }
 
 func (a *argument) AsInt8() (int8, error) {
-	i, err := a.value.(json.Number).Int64()
+	i, err := a.number().Int64()
 	return int8(i), err
 }
 
 func (a *argument) AsInt16() (int16, error) {
-	i, err := a.value.(json.Number).Int64()
+	i, err := a.number().Int64()
 	return int16(i), err
 }
 
 func (a *argument) AsInt32() (int32, error) {
-	i, err := a.value.(json.Number).Int64()
+	i, err := a.number().Int64()
 	return int32(i), err
 }
 
 func (a *argument) AsInt64() (int64, error) {
-	i, err := a.value.(json.Number).Int64()
+	i, err := a.number().Int64()
 	return i, err
 }
 
@@ -91,15 +92,27 @@ func (a *argument) AsBool() (bool, error) {
 }
 
 func (a *argument) AsFloat32() (float32, error) {
-	f, err := a.value.(json.Number).Float64()
+	f, err := a.number().Float64()
 	return float32(f), err
 }
 
 func (a *argument) AsFloat64() (float64, error) {
-	f, err := a.value.(json.Number).Float64()
+	f, err := a.number().Float64()
 	return f, err
 }
 
+// number returns the argument as a json.Number. Codecs other than JSON decode numbers as Go numeric types.
+func (a *argument) number() json.Number {
+	switch v := a.value.(type) {
+	case json.Number:
+		return v
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return json.Number(fmt.Sprint(v))
+	}
+
+	return ""
+}
+
 func (a *argument) Raw() interface{} {
 	return a.value
 }
@@ -0,0 +1,48 @@
+package porthos
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff is the retry policy of the broker reconnection and of the client and server consumption.
+// The delay grows from Initial by Multiplier after every failed attempt, up to Max.
+type Backoff struct {
+	// Initial is the delay after the first failed attempt, defaults to Config.ReconnectInterval.
+	Initial time.Duration
+	// Max caps the delay, no cap if zero.
+	Max time.Duration
+	// Multiplier applied to the delay after every failed attempt, values below 1 keep it constant.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction of it (0 to 1), so clients don't retry in lockstep.
+	Jitter float64
+	// MaxAttempts is the number of failed attempts before giving up with ErrRetriesExhausted.
+	// Zero retries forever.
+	MaxAttempts int
+}
+
+// Delay returns how long to wait after the given failed attempt, starting at 0.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Initial)
+
+	if b.Multiplier > 1 {
+		delay *= math.Pow(b.Multiplier, float64(attempt))
+	}
+
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		jitter := math.Min(b.Jitter, 1)
+		delay += delay * jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay)
+}
+
+// Exhausted reports whether no attempt must follow the given number of failed attempts.
+func (b Backoff) Exhausted(attempts int) bool {
+	return b.MaxAttempts > 0 && attempts >= b.MaxAttempts
+}
@@ -0,0 +1,37 @@
+package porthos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+
+	assert.Equal(t, 100*time.Millisecond, b.Delay(0))
+	assert.Equal(t, 200*time.Millisecond, b.Delay(1))
+	assert.Equal(t, 800*time.Millisecond, b.Delay(3))
+	assert.Equal(t, time.Second, b.Delay(4))
+
+	constant := Backoff{Initial: 100 * time.Millisecond}
+
+	assert.Equal(t, 100*time.Millisecond, constant.Delay(5))
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Jitter: 0.5}
+
+	for i := 0; i < 100; i++ {
+		delay := b.Delay(0)
+
+		assert.True(t, delay >= 50*time.Millisecond && delay <= 150*time.Millisecond, "Delay out of bounds: %s", delay)
+	}
+}
+
+func TestBackoffExhausted(t *testing.T) {
+	assert.False(t, Backoff{}.Exhausted(100))
+	assert.False(t, Backoff{MaxAttempts: 3}.Exhausted(2))
+	assert.True(t, Backoff{MaxAttempts: 3}.Exhausted(3))
+}
@@ -1,9 +1,9 @@
 package porthos
 
 import (
+	"context"
 	"errors"
 	"log"
-	"net"
 	"sync"
 	"time"
 
@@ -12,23 +12,62 @@ import (
 
 var (
 	ErrBrokerNotConnected = errors.New("Broker not connected to server.")
+	ErrBrokerClosed       = errors.New("Broker closed.")
+	ErrNoBrokerURL        = errors.New("No broker url given.")
+	ErrRetriesExhausted   = errors.New("Maximum retry attempts reached.")
+	ErrBrokerBlocked      = errors.New("Broker blocked publishing (flow control).")
 )
 
 // Broker holds an implementation-specific connection.
 type Broker struct {
 	config       Config
-	connection   *amqp.Connection
+	connection   Connection
+	closes       chan *amqp.Error
 	m            sync.Mutex
-	url          string
+	urls         []string
+	current      int
 	closed       bool
 	connected    bool
+	err          error
+	done         chan struct{}
 	reestablishs []chan bool
+	publishers   *channelPool
+
+	// blockedLock guards the flow control state. The amqp dispatcher waits for watchBlocked,
+	// so it must not take the broker lock, which is held while talking to the connection.
+	blockedLock sync.Mutex
+	blockedConn Connection
+	unblocked   chan struct{}
+
+	subscriptionsLock sync.Mutex
+	subscriptions     map[*Subscription]bool
 }
 
 // Config to be used when creating a new connection.
 type Config struct {
 	ReconnectInterval time.Duration
 	DialTimeout       time.Duration
+	// Backoff between the reconnection attempts. When Backoff.Initial is not set,
+	// it retries forever every ReconnectInterval.
+	Backoff Backoff
+	// BlockedTimeout is how long a publish waits for the broker to unblock the connection
+	// (see Broker.IsBlocked) before failing with ErrBrokerBlocked. Zero fails right away.
+	BlockedTimeout time.Duration
+	// PublishChannels is the number of confirm mode channels shared by the publishers, defaults to DefaultPublishChannels.
+	PublishChannels int
+	// Transport used to connect to the broker, defaults to AMQP.
+	Transport Transport
+	// TLS settings used by amqps urls.
+	TLS *TLSConfig
+	// SASL mechanisms to authenticate with, in order of preference.
+	// Defaults to the credentials of the url, use ExternalAuth to authenticate with the TLS client certificate.
+	SASL []amqp.Authentication
+	// Heartbeat interval, the server's one is used if less than 1s.
+	Heartbeat time.Duration
+	// Vhost overrides the virtual host of the url.
+	Vhost string
+	// ConnectionName identifies the connection in the RabbitMQ management UI.
+	ConnectionName string
 }
 
 // NewBroker creates a new instance of AMQP connection.
@@ -41,23 +80,46 @@ func NewBroker(amqpURL string) (*Broker, error) {
 
 // NewBrokerConfig returns an AMQP Connection.
 func NewBrokerConfig(amqpURL string, config Config) (*Broker, error) {
-	conn, err := amqp.DialConfig(amqpURL, amqp.Config{
-		Dial: func(network, addr string) (net.Conn, error) {
-			return net.DialTimeout(network, addr, config.DialTimeout)
-		},
-	})
+	return NewClusterBroker([]string{amqpURL}, config)
+}
 
-	if err != nil {
-		return nil, err
+// NewClusterBroker connects to the first available node of a cluster.
+// When the connection is lost, it reconnects to the next node of the list, rotating through all of them.
+func NewClusterBroker(urls []string, config Config) (*Broker, error) {
+	if len(urls) == 0 {
+		return nil, ErrNoBrokerURL
+	}
+
+	if config.Transport == nil {
+		config.Transport = NewAMQPTransport()
+	}
+
+	if config.Backoff.Initial <= 0 {
+		config.Backoff.Initial = config.ReconnectInterval
 	}
 
 	b := &Broker{
-		connection: conn,
-		url:        amqpURL,
-		config:     config,
-		connected:  true,
+		urls:          append([]string(nil), urls...),
+		config:        config,
+		done:          make(chan struct{}),
+		subscriptions: make(map[*Subscription]bool),
 	}
 
+	conn, current, err := b.dial(0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.connection = conn
+	b.closes = conn.NotifyClose(make(chan *amqp.Error, 1))
+	b.current = current
+	b.connected = true
+	b.resetBlocked(conn)
+
+	b.publishers = newChannelPool(config.PublishChannels, b.openChannel)
+
+	go b.watchBlocked(conn, b.urls[current], conn.NotifyBlocked(make(chan amqp.Blocking, 1)))
 	go b.handleConnectionClose()
 
 	return b, nil
@@ -68,21 +130,62 @@ func (b *Broker) Close() {
 	b.m.Lock()
 	defer b.m.Unlock()
 
+	b.stop(ErrBrokerClosed)
+	b.publishers.reset()
 	b.connection.Close()
 }
 
+// Done returns a channel closed when the broker stops for good,
+// either because it was closed or because it gave up reconnecting.
+func (b *Broker) Done() <-chan struct{} {
+	return b.done
+}
+
+// Err returns why the broker stopped: ErrBrokerClosed or ErrRetriesExhausted.
+// It returns nil while the broker is running.
+func (b *Broker) Err() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.err
+}
+
+// stop must be called holding the lock.
+func (b *Broker) stop(err error) {
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	b.err = err
+	close(b.done)
+
+	b.emit(Event{Type: EventClosed, URL: b.urls[b.current], Err: err})
+}
+
 // NotifyConnectionClose writes in the returned channel when the connection with the broker closes.
 func (b *Broker) NotifyConnectionClose() <-chan error {
-	ch := make(chan error)
+	ch := make(chan error, 1)
+
+	b.m.Lock()
+	closes := b.connection.NotifyClose(make(chan *amqp.Error, 1))
+	b.m.Unlock()
 
 	go func() {
-		ch <- <-b.connection.NotifyClose(make(chan *amqp.Error, 1))
+		// a nil *amqp.Error must not become a non-nil error.
+		if err := <-closes; err != nil {
+			ch <- err
+		} else {
+			ch <- nil
+		}
 	}()
 
 	return ch
 }
 
 // NotifyReestablish returns a channel to notify when the connection is restablished.
+// Notifications are not queued: an unread one makes the following ones be dropped.
+// See StopNotifyReestablish, and Subscribe for all the lifecycle events.
 func (b *Broker) NotifyReestablish() <-chan bool {
 	receiver := make(chan bool, 1)
 
@@ -93,11 +196,41 @@ func (b *Broker) NotifyReestablish() <-chan bool {
 	return receiver
 }
 
+// StopNotifyReestablish stops notifying a receiver returned by NotifyReestablish.
+func (b *Broker) StopNotifyReestablish(receiver <-chan bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for i, c := range b.reestablishs {
+		if c == receiver {
+			// copied, the slice may be being iterated by handleConnectionClose.
+			b.reestablishs = append(b.reestablishs[:i:i], b.reestablishs[i+1:]...)
+			return
+		}
+	}
+}
+
 // WaitUntilConnectionCloses holds the execution until the connection closes.
 func (b *Broker) WaitUntilConnectionCloses() {
 	<-b.NotifyConnectionClose()
 }
 
+// URL returns the url of the node the broker is connected to, or was connected to last.
+func (b *Broker) URL() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.urls[b.current]
+}
+
+// IsBlocked reports whether the broker is refusing publishes, usually because of a memory or disk alarm.
+func (b *Broker) IsBlocked() bool {
+	b.blockedLock.Lock()
+	defer b.blockedLock.Unlock()
+
+	return b.unblocked != nil
+}
+
 func (b *Broker) IsConnected() bool {
 	b.m.Lock()
 	defer b.m.Unlock()
@@ -105,22 +238,104 @@ func (b *Broker) IsConnected() bool {
 	return b.connected
 }
 
-func (b *Broker) setConnected(connected bool) {
+func (b *Broker) isClosed() bool {
 	b.m.Lock()
 	defer b.m.Unlock()
 
-	b.connected = connected
+	return b.closed
 }
 
-func (b *Broker) openChannel() (*amqp.Channel, error) {
+func (b *Broker) openChannel() (Channel, error) {
 	b.m.Lock()
 	defer b.m.Unlock()
 
 	return b.connection.Channel()
 }
 
+// publish sends the message on a pooled confirm mode channel and waits for the broker confirmation.
+func (b *Broker) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	if err := b.waitUnblocked(ctx); err != nil {
+		return err
+	}
+
+	return b.publishers.publish(ctx, exchange, key, msg)
+}
+
+// waitUnblocked waits up to the BlockedTimeout for the connection to be unblocked.
+// It returns ErrBrokerBlocked if it is still blocked, or the context error.
+func (b *Broker) waitUnblocked(ctx context.Context) error {
+	b.blockedLock.Lock()
+	unblocked := b.unblocked
+	b.blockedLock.Unlock()
+
+	if unblocked == nil {
+		return nil
+	}
+
+	if b.config.BlockedTimeout <= 0 {
+		return ErrBrokerBlocked
+	}
+
+	timer := time.NewTimer(b.config.BlockedTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-unblocked:
+		return nil
+	case <-timer.C:
+		return ErrBrokerBlocked
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.done:
+		return b.Err()
+	}
+}
+
+// resetBlocked tracks the flow control of a new connection, which starts unblocked.
+func (b *Broker) resetBlocked(conn Connection) {
+	b.blockedLock.Lock()
+	defer b.blockedLock.Unlock()
+
+	b.blockedConn = conn
+	b.setBlocked(false)
+}
+
+// setBlocked must be called holding the blocked lock.
+func (b *Broker) setBlocked(blocked bool) {
+	if blocked && b.unblocked == nil {
+		b.unblocked = make(chan struct{})
+	} else if !blocked && b.unblocked != nil {
+		close(b.unblocked)
+		b.unblocked = nil
+	}
+}
+
+// dial tries the nodes in order, starting at the given index.
+// It returns the connection and the index of the node, or the last error if none is available.
+func (b *Broker) dial(start int) (Connection, int, error) {
+	var err error
+
+	for i := 0; i < len(b.urls); i++ {
+		current := (start + i) % len(b.urls)
+
+		var conn Connection
+		conn, err = b.config.Transport.Dial(b.urls[current], b.config)
+
+		if err == nil {
+			return conn, current, nil
+		}
+	}
+
+	return nil, 0, err
+}
+
 func (b *Broker) reestablish() error {
-	conn, err := amqp.Dial(b.url)
+	b.m.Lock()
+	next := b.current + 1
+	b.m.Unlock()
+
+	// the node that was lost is tried last.
+	conn, current, err := b.dial(next)
 
 	if err != nil {
 		return err
@@ -129,33 +344,113 @@ func (b *Broker) reestablish() error {
 	b.m.Lock()
 	defer b.m.Unlock()
 
+	if b.closed {
+		conn.Close()
+		return ErrBrokerClosed
+	}
+
 	b.connection = conn
+	b.resetBlocked(conn)
+	// registered right away, so the cause of an early close is not missed.
+	b.closes = conn.NotifyClose(make(chan *amqp.Error, 1))
+	b.current = current
+	b.publishers.reset()
 
 	return nil
 }
 
 func (b *Broker) handleConnectionClose() {
-	for !b.closed {
-		b.WaitUntilConnectionCloses()
-		b.setConnected(false)
+	for !b.isClosed() {
+		b.m.Lock()
+		closes := b.closes
+		b.m.Unlock()
 
-		for i := 0; !b.closed; i++ {
+		var cause error
+
+		if err := <-closes; err != nil {
+			cause = err
+		}
+
+		b.m.Lock()
+		b.connected = false
+
+		if !b.closed {
+			b.emit(Event{Type: EventDisconnected, URL: b.urls[b.current], Err: cause})
+		}
+
+		b.m.Unlock()
+
+		for i := 0; !b.isClosed(); i++ {
 			err := b.reestablish()
 
 			if err == nil {
-				b.setConnected(true)
+				b.m.Lock()
+				b.connected = true
+				b.emit(Event{Type: EventReconnected, URL: b.urls[b.current]})
+				conn, url := b.connection, b.urls[b.current]
+				reestablishs := b.reestablishs
+				b.m.Unlock()
+
 				log.Printf("[PORTHOS] Connection reestablished")
 
-				for _, c := range b.reestablishs {
-					c <- true
+				go b.watchBlocked(conn, url, conn.NotifyBlocked(make(chan amqp.Blocking, 1)))
+
+				for _, c := range reestablishs {
+					select {
+					case c <- true:
+					default:
+					}
 				}
 
 				break
-			} else {
-				log.Printf("[PORTHOS] Error reestablishing connection, attempt %d. Retrying... [%s]", i, err)
+			}
+
+			b.m.Lock()
+			b.emit(Event{Type: EventReconnectAttempt, Err: err, Attempt: i + 1})
 
-				time.Sleep(b.config.ReconnectInterval)
+			exhausted := b.config.Backoff.Exhausted(i + 1)
+
+			if exhausted {
+				b.stop(ErrRetriesExhausted)
+			}
+
+			b.m.Unlock()
+
+			if exhausted {
+				log.Printf("[PORTHOS] Error reestablishing connection, attempt %d. Giving up. [%s]", i, err)
+				return
+			}
+
+			log.Printf("[PORTHOS] Error reestablishing connection, attempt %d. Retrying... [%s]", i, err)
+
+			select {
+			case <-time.After(b.config.Backoff.Delay(i)):
+			case <-b.done:
 			}
 		}
 	}
 }
+
+// watchBlocked emits the flow control notifications of a connection until it closes.
+// It never takes the broker lock, see blockedLock.
+func (b *Broker) watchBlocked(conn Connection, url string, blocks <-chan amqp.Blocking) {
+	for blocking := range blocks {
+		b.blockedLock.Lock()
+
+		// late notifications of a replaced connection don't apply.
+		if b.blockedConn != conn {
+			b.blockedLock.Unlock()
+			continue
+		}
+
+		b.setBlocked(blocking.Active)
+
+		if blocking.Active {
+			b.emit(Event{Type: EventBlocked, URL: url, Reason: blocking.Reason})
+		} else {
+			b.emit(Event{Type: EventUnblocked, URL: url})
+		}
+
+		b.blockedLock.Unlock()
+	}
+}
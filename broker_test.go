@@ -0,0 +1,248 @@
+package porthos
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// clusterTransport is a memory transport whose nodes can be taken down by url.
+type clusterTransport struct {
+	*MemoryTransport
+	m    sync.Mutex
+	down map[string]bool
+}
+
+func newClusterTransport() *clusterTransport {
+	return &clusterTransport{MemoryTransport: NewMemoryTransport(), down: make(map[string]bool)}
+}
+
+func (t *clusterTransport) Dial(url string, config Config) (Connection, error) {
+	t.m.Lock()
+	down := t.down[url]
+	t.m.Unlock()
+
+	if down {
+		return nil, ErrBrokerNotConnected
+	}
+
+	return t.MemoryTransport.Dial(url, config)
+}
+
+func (t *clusterTransport) setDown(url string, down bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.down[url] = down
+}
+
+func TestClusterBrokerFailover(t *testing.T) {
+	transport := newClusterTransport()
+	transport.setDown("memory://a", true)
+
+	b, err := NewClusterBroker([]string{"memory://a", "memory://b"}, Config{
+		ReconnectInterval: 10 * time.Millisecond,
+		Transport:         transport,
+	})
+
+	if assert.Nil(t, err) {
+		defer b.Close()
+
+		assert.Equal(t, "memory://b", b.URL())
+
+		rs := b.NotifyReestablish()
+
+		transport.setDown("memory://a", false)
+		transport.setDown("memory://b", true)
+		transport.Disconnect()
+
+		select {
+		case <-rs:
+			assert.Equal(t, "memory://a", b.URL())
+		case <-time.After(time.Second):
+			t.Fatal("Connection not reestablished. Timedout.")
+		}
+	}
+}
+
+func TestClusterBrokerUnavailable(t *testing.T) {
+	transport := newClusterTransport()
+	transport.setDown("memory://a", true)
+
+	_, err := NewClusterBroker([]string{"memory://a"}, Config{Transport: transport})
+	assert.Equal(t, ErrBrokerNotConnected, err)
+
+	_, err = NewClusterBroker(nil, Config{Transport: transport})
+	assert.Equal(t, ErrNoBrokerURL, err)
+}
+
+func TestBrokerGivesUpReconnecting(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	b, err := NewBrokerConfig("memory://", Config{
+		Transport: transport,
+		Backoff:   Backoff{Initial: time.Millisecond, Multiplier: 2, MaxAttempts: 3},
+	})
+
+	if assert.Nil(t, err) {
+		defer b.Close()
+
+		client, err := NewClient(b, "TestBrokerGivesUpReconnecting", time.Second)
+		assert.Nil(t, err)
+
+		server, err := NewServer(b, "TestBrokerGivesUpReconnecting", Options{})
+		assert.Nil(t, err)
+
+		go server.ListenAndServe()
+
+		transport.SetDialError(ErrBrokerNotConnected)
+		transport.Disconnect()
+
+		select {
+		case <-b.Done():
+			assert.Equal(t, ErrRetriesExhausted, b.Err())
+		case <-time.After(time.Second):
+			t.Fatal("Broker did not give up. Timedout.")
+		}
+
+		// the client stops with the broker.
+		for i := 0; i < 100 && client.Err() == nil; i++ {
+			time.Sleep(time.Millisecond)
+		}
+
+		_, err = client.Call("method").Sync()
+		assert.Equal(t, ErrRetriesExhausted, err)
+
+		// the server stops with the broker.
+		select {
+		case <-server.Done():
+			assert.Equal(t, ErrRetriesExhausted, server.Err())
+		case <-time.After(time.Second):
+			t.Fatal("Server did not stop. Timedout.")
+		}
+	}
+}
+
+// blockBroker blocks the transport and waits for the broker to notice it.
+func blockBroker(t *testing.T, b *Broker, transport *MemoryTransport) {
+	sub := b.Subscribe()
+	defer sub.Unsubscribe()
+
+	transport.Block("low on memory")
+
+	for e := receiveEvent(t, sub); e.Type != EventBlocked; e = receiveEvent(t, sub) {
+	}
+}
+
+func TestBrokerBlockedFailFast(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	b := newMemoryBroker(t, transport)
+	defer b.Close()
+
+	client, err := NewClient(b, "TestBrokerBlockedFailFast", time.Second)
+
+	if assert.Nil(t, err) {
+		defer client.Close()
+
+		blockBroker(t, b, transport)
+		assert.True(t, b.IsBlocked())
+
+		_, err = client.Call("method").Sync()
+		assert.Equal(t, ErrBrokerBlocked, err)
+
+		assert.Equal(t, ErrBrokerBlocked, client.Call("method").Void())
+	}
+}
+
+func TestBrokerBlockedTimeout(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	b, err := NewBrokerConfig("memory://", Config{
+		Transport:      transport,
+		BlockedTimeout: 50 * time.Millisecond,
+	})
+
+	if assert.Nil(t, err) {
+		defer b.Close()
+
+		blockBroker(t, b, transport)
+
+		started := time.Now()
+
+		assert.Equal(t, ErrBrokerBlocked, b.publish(context.Background(), "", "test", amqp.Publishing{}))
+		assert.True(t, time.Since(started) >= 50*time.Millisecond, "Publish must wait for the broker to unblock.")
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			transport.Unblock()
+		}()
+
+		assert.Nil(t, b.publish(context.Background(), "", "test", amqp.Publishing{}))
+		assert.False(t, b.IsBlocked())
+	}
+}
+
+// dispatchingTransport opens channels like amqp may do: waiting for the flow control
+// notifications to be delivered first.
+type dispatchingTransport struct {
+	*MemoryTransport
+}
+
+func (t *dispatchingTransport) Dial(url string, config Config) (Connection, error) {
+	conn, err := t.MemoryTransport.Dial(url, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &dispatchingConnection{Connection: conn}, nil
+}
+
+type dispatchingConnection struct {
+	Connection
+	blocks chan amqp.Blocking
+}
+
+func (c *dispatchingConnection) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	c.blocks = receiver
+	return receiver
+}
+
+func (c *dispatchingConnection) Channel() (Channel, error) {
+	// with the receiver buffering one, the last one is only sent once the first one is handled.
+	for i := 0; i < 3; i++ {
+		c.blocks <- amqp.Blocking{Active: true, Reason: "low on memory"}
+	}
+
+	return c.Connection.Channel()
+}
+
+func TestBrokerBlockedWhileOpeningChannel(t *testing.T) {
+	b, err := NewBrokerConfig("memory://", Config{
+		Transport: &dispatchingTransport{NewMemoryTransport()},
+	})
+
+	if assert.Nil(t, err) {
+		defer b.Close()
+
+		opened := make(chan error, 1)
+
+		go func() {
+			_, err := b.openChannel()
+			opened <- err
+		}()
+
+		select {
+		case err := <-opened:
+			assert.Nil(t, err)
+			assert.True(t, b.IsBlocked())
+		case <-time.After(time.Second):
+			t.Fatal("Channel not opened. Timedout.")
+		}
+	}
+}
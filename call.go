@@ -1,9 +1,9 @@
 package porthos
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/streadway/amqp"
@@ -15,6 +15,7 @@ type call struct {
 	method      string
 	body        []byte
 	contentType string
+	headers     *Headers
 }
 
 // Map is an abstraction for map[string]interface{} to be used with WithMap.
@@ -22,7 +23,15 @@ type Map map[string]interface{}
 
 // NewCall creates a new RPC call object.
 func newCall(client *Client, method string) *call {
-	return &call{client: client, method: method}
+	c := &call{client: client, method: method, headers: NewHeaders()}
+
+	c.headers.Set(AcceptEncodingHeader, builtinEncodings)
+
+	if client.accept != "" {
+		c.headers.Set(AcceptHeader, client.accept)
+	}
+
+	return c
 }
 
 // WithTimeout defines the timeut for this specific call.
@@ -31,6 +40,20 @@ func (c *call) WithTimeout(timeout time.Duration) *call {
 	return c
 }
 
+// WithHeader defines a request header, the server reads it through Request.GetHeaders.
+// Values must be supported by AMQP tables (strings, integers, floats, booleans, etc).
+func (c *call) WithHeader(key string, value interface{}) *call {
+	c.headers.Set(key, value)
+	return c
+}
+
+// WithAccept defines the content types accepted in the response, in order of preference.
+// It overrides the Accept option of the client.
+func (c *call) WithAccept(contentTypes ...string) *call {
+	c.headers.Set(AcceptHeader, strings.Join(contentTypes, ", "))
+	return c
+}
+
 // WithBody defines the given bytes array as the request body.
 func (c *call) WithBody(body []byte) *call {
 	c.body = body
@@ -47,30 +70,36 @@ func (c *call) WithBodyContentType(body []byte, contentType string) *call {
 	return c
 }
 
-// WitArgs defines the given args as the request body.
+// WitArgs defines the given args as the request body, encoded with the client content type.
 func (c *call) WithArgs(args ...interface{}) *call {
-	return c.withJSON(args)
+	return c.withEncoded(args)
 }
 
-// WithMap defines the given map as the request body.
+// WithMap defines the given map as the request body, encoded with the client content type.
 func (c *call) WithMap(m map[string]interface{}) *call {
-	return c.withJSON(m)
+	return c.withEncoded(m)
 }
 
-// WithStruct defines the given struct as the request body.
+// WithStruct defines the given struct as the request body, encoded with the client content type.
 func (c *call) WithStruct(i interface{}) *call {
-	return c.withJSON(i)
+	return c.withEncoded(i)
 }
 
-func (c *call) withJSON(i interface{}) *call {
-	data, err := json.Marshal(i)
+func (c *call) withEncoded(i interface{}) *call {
+	contentType := c.client.contentType
+
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+
+	data, err := Marshal(contentType, i)
 
 	if err != nil {
 		panic(err)
 	}
 
 	c.body = data
-	c.contentType = "application/json"
+	c.contentType = contentType
 
 	return c
 }
@@ -78,111 +107,329 @@ func (c *call) withJSON(i interface{}) *call {
 // Async calls the remote method with the given arguments.
 // It returns a *Slot (which contains the response channel) and any possible error.
 func (c *call) Async() (Slot, error) {
+	return c.AsyncContext(context.Background())
+}
+
+// AsyncContext calls the remote method with the given arguments.
+// The message expiration is bounded by the context deadline and the returned slot
+// is disposed when the context is done.
+func (c *call) AsyncContext(ctx context.Context) (Slot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := c.client.Err(); err != nil {
+		return nil, err
+	}
+
 	if !c.client.broker.IsConnected() {
 		return nil, ErrBrokerNotConnected
 	}
 
 	res := NewSlot()
-	correlationID, err := res.GetCorrelationID()
 
-	if err != nil {
+	if _, err := res.GetCorrelationID(); err != nil {
 		return nil, err
 	}
 
-	c.client.pushSlot(correlationID, res)
+	var err error
 
-	ch, err := c.client.broker.openChannel()
+	if len(c.client.getInterceptors()) == 0 {
+		err = c.publishAsync(ctx, c.invocation(false), res)
+	} else {
+		err = c.interceptAsync(ctx, res)
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer ch.Close()
+	disposeWhenDone(ctx, res)
+
+	return res, nil
+}
+
+// interceptAsync runs the interceptors in background, so they observe the response.
+// It returns once the request is published or an interceptor aborts the call.
+// Like Sync, the interceptors wait for the response until the call timeout.
+func (c *call) interceptAsync(ctx context.Context, res *slot) error {
+	ctx, cancel := context.WithTimeout(ctx, c.getTimeout())
+	res.onDispose = cancel
+
+	published := make(chan error, 1)
 
-	if err := ch.Confirm(false); err != nil {
-		return nil, fmt.Errorf("Channel could not be put into confirm mode: %s", err)
+	notify := func(err error) {
+		select {
+		case published <- err:
+		default:
+		}
 	}
 
-	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	go func() {
+		defer cancel()
+
+		response, err := c.client.intercept(ctx, c.invocation(false), func(ctx context.Context, inv *Invocation) (*ClientResponse, error) {
+			inner := NewSlot()
+			inner.id = res.id
 
-	err = ch.Publish(
-		"",                   // exchange
-		c.client.serviceName, // routing key
-		false,                // mandatory
-		false,                // immediate
-		amqp.Publishing{
-			Headers: amqp.Table{
-				"X-Method": c.method,
-			},
-			Expiration:    strconv.FormatInt(c.getTimeoutMilliseconds(), 10),
-			ContentType:   c.contentType,
-			CorrelationId: correlationID,
-			ReplyTo:       c.client.responseQueueName,
-			Body:          c.body,
+			err := c.publishAsync(ctx, inv, inner)
+			notify(err)
+
+			if err != nil {
+				return nil, err
+			}
+
+			defer inner.Dispose()
+
+			return c.wait(ctx, inv, inner)
 		})
 
+		// the call was aborted before publishing.
+		notify(err)
+
+		if response != nil {
+			res.sendResponse(*response)
+		} else {
+			// e.g. timed out, no response will ever come.
+			res.Dispose()
+		}
+	}()
+
+	return <-published
+}
+
+// publishAsync registers the slot and publishes the request, replies are delivered to the slot.
+func (c *call) publishAsync(ctx context.Context, inv *Invocation, res *slot) error {
+	res.onDispose = chainDispose(res.onDispose, func() {
+		c.client.popSlot(res.id)
+	})
+
+	c.client.pushSlot(res.id, res)
+
+	err := c.publish(ctx, inv, res.id)
+
 	if err != nil {
-		return nil, err
-	} else {
-		if confirmed := <-confirms; !confirmed.Ack {
-			return nil, ErrNotAcked
+		res.Dispose()
+		return err
+	}
+
+	return nil
+}
+
+func (c *call) publish(ctx context.Context, inv *Invocation, correlationID string) error {
+	body, encoding, err := c.client.compression.compress(inv.Body)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	msg := amqp.Publishing{
+		Headers:         inv.publishingHeaders(now),
+		Timestamp:       now,
+		Expiration:      formatExpiration(c.getExpiration(ctx)),
+		ContentType:     inv.ContentType,
+		ContentEncoding: encoding,
+		CorrelationId:   correlationID,
+		ReplyTo:         c.client.replyTo(),
+		Body:            body,
+	}
+
+	// with direct reply-to, requests must be published on the channel consuming the responses.
+	if c.client.directReplyTo {
+		if err := c.client.broker.waitUnblocked(ctx); err != nil {
+			return err
 		}
+
+		rc := c.client.getReplyChannel()
+
+		if rc == nil {
+			return ErrBrokerNotConnected
+		}
+
+		return c.client.claimCheck.publish(ctx, rc, "", inv.ServiceName, msg)
 	}
 
-	return res, nil
+	return c.client.claimCheck.publish(ctx, c.client.broker, "", inv.ServiceName, msg)
+}
+
+// wait for the response delivered to the slot until the context is done.
+func (c *call) wait(ctx context.Context, inv *Invocation, res *slot) (*ClientResponse, error) {
+	select {
+	case response, ok := <-res.ResponseChannel():
+		if ok {
+			if response.isMethodNotFound() {
+				return nil, &MethodNotFoundError{ServiceName: inv.ServiceName, MethodName: inv.Method, cause: response.Err()}
+			}
+
+			return &response, nil
+		}
+
+		return nil, ctx.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 // Sync calls the remote method with the given arguments.
 // It returns a Response and any possible error.
 func (c *call) Sync() (*ClientResponse, error) {
-	slot, err := c.Async()
+	return c.SyncContext(context.Background())
+}
+
+// SyncContext calls the remote method with the given arguments and waits for the response
+// until the call timeout or the context deadline, whichever comes first.
+// It returns ErrTimedOut if the deadline is exceeded, the context error if it is canceled
+// and a *MethodNotFoundError if the service does not have the method.
+func (c *call) SyncContext(ctx context.Context) (*ClientResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	if err := c.client.Err(); err != nil {
+		return nil, err
+	}
+
+	if !c.client.broker.IsConnected() {
+		return nil, ErrBrokerNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.getTimeout())
+	defer cancel()
+
+	response, err := c.client.intercept(ctx, c.invocation(false), func(ctx context.Context, inv *Invocation) (*ClientResponse, error) {
+		res := NewSlot()
+
+		if _, err := res.GetCorrelationID(); err != nil {
+			return nil, err
+		}
+
+		if err := c.publishAsync(ctx, inv, res); err != nil {
+			return nil, err
+		}
+
+		defer res.Dispose()
+
+		return c.wait(ctx, inv, res)
+	})
+
+	return response, contextError(err)
+}
+
+// Stream calls a streaming method (see Server.RegisterStream) and returns the stream of its chunks.
+func (c *call) Stream() (*ClientStream, error) {
+	return c.StreamContext(context.Background())
+}
+
+// StreamContext calls a streaming method and returns the stream of its chunks.
+// The call timeout bounds the whole stream, the server stops streaming when it is exceeded.
+// Canceling the context or closing the stream cancels it on the server as well.
+// Interceptors see the call, but not the chunks.
+func (c *call) StreamContext(ctx context.Context) (*ClientStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	if err := c.client.Err(); err != nil {
+		return nil, err
+	}
+
+	if !c.client.broker.IsConnected() {
+		return nil, ErrBrokerNotConnected
+	}
+
+	id, err := NewUUIDv4()
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer slot.Dispose()
+	window := c.client.streamWindow
 
-	select {
-	case response := <-slot.ResponseChannel():
-		return &response, nil
-	case <-time.After(c.getTimeout()):
-		return nil, ErrTimedOut
+	if window <= 0 {
+		window = DefaultStreamWindow
+	}
+
+	stream := newClientStream(ctx, c.client, id, window, c.getTimeout())
+	c.client.pushStream(id, stream)
+
+	c.headers.Set(streamWindowHeader, int32(window))
+
+	_, err = c.client.intercept(stream.ctx, c.invocation(false), func(ctx context.Context, inv *Invocation) (*ClientResponse, error) {
+		return nil, c.publish(ctx, inv, id)
+	})
+
+	if err != nil {
+		stream.finish(err, false)
+		return nil, contextError(err)
 	}
+
+	return stream, nil
 }
 
 // Void calls a remote service procedure/service which will not provide any return value.
 func (c *call) Void() error {
+	return c.VoidContext(context.Background())
+}
+
+// VoidContext calls a remote service procedure/service which will not provide any return value.
+// If the context has a deadline, the message expires when it is reached.
+func (c *call) VoidContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := c.client.Err(); err != nil {
+		return err
+	}
+
 	if !c.client.broker.IsConnected() {
 		return ErrBrokerNotConnected
 	}
 
-	ch, err := c.client.broker.openChannel()
+	_, err := c.client.intercept(ctx, c.invocation(true), c.publishVoid)
+
+	return err
+}
+
+func (c *call) publishVoid(ctx context.Context, inv *Invocation) (*ClientResponse, error) {
+	var expiration string
+
+	body, encoding, err := c.client.compression.compress(inv.Body)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer ch.Close()
+	now := time.Now()
 
-	err = ch.Publish(
-		"",                   // exchange
-		c.client.serviceName, // routing key
-		false,                // mandatory
-		false,                // immediate
-		amqp.Publishing{
-			Headers: amqp.Table{
-				"X-Method": c.method,
-			},
-			ContentType: c.contentType,
-			Body:        c.body,
-		})
+	if deadline, ok := ctx.Deadline(); ok {
+		expiration = formatExpiration(deadline.Sub(now))
+	}
 
-	if err != nil {
-		return err
+	msg := amqp.Publishing{
+		Headers:         inv.publishingHeaders(now),
+		Timestamp:       now,
+		Expiration:      expiration,
+		ContentType:     inv.ContentType,
+		ContentEncoding: encoding,
+		Body:            body,
 	}
 
-	return nil
+	return nil, c.client.claimCheck.publish(ctx, c.client.broker, "", inv.ServiceName, msg)
+}
+
+// invocation describes this call to the interceptors.
+func (c *call) invocation(void bool) *Invocation {
+	return &Invocation{
+		ServiceName: c.client.serviceName,
+		Method:      c.method,
+		ContentType: c.contentType,
+		Body:        c.body,
+		Headers:     c.headers.clone(),
+		Void:        void,
+	}
 }
 
 func (c *call) getTimeout() time.Duration {
@@ -193,12 +440,41 @@ func (c *call) getTimeout() time.Duration {
 	return c.client.defaultTTL
 }
 
-func (c *call) getTimeoutMilliseconds() int64 {
-	t := c.client.defaultTTL
+// getExpiration returns the call timeout bounded by the context deadline.
+func (c *call) getExpiration(ctx context.Context) time.Duration {
+	ttl := c.getTimeout()
 
-	if c.timeout > 0 {
-		t = c.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < ttl {
+			ttl = remaining
+		}
+	}
+
+	return ttl
+}
+
+// formatExpiration formats a duration as an AMQP expiration, at least one millisecond.
+func formatExpiration(d time.Duration) string {
+	ms := int64(d / time.Millisecond)
+
+	if ms < 1 {
+		ms = 1
+	}
+
+	return strconv.FormatInt(ms, 10)
+}
+
+// unixMilliseconds returns t as milliseconds since the epoch.
+// The AMQP timestamp property only holds seconds, too coarse for short TTLs.
+func unixMilliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// contextError translates an exceeded deadline into ErrTimedOut.
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrTimedOut
 	}
 
-	return int64(t / time.Millisecond)
+	return err
 }
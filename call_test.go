@@ -1,7 +1,9 @@
 package porthos
 
 import (
+	"context"
 	"testing"
+	"time"
 )
 
 func TestCallWithDefaultTimeout(t *testing.T) {
@@ -45,3 +47,59 @@ func TestCallWithMap(t *testing.T) {
 		t.Errorf("Got an unexpected body: %s", string(c.body))
 	}
 }
+
+func TestCallExpirationFromContextDeadline(t *testing.T) {
+	c := newCall(&Client{defaultTTL: time.Minute}, "doSomething")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	expiration := c.getExpiration(ctx)
+
+	if expiration > time.Second || expiration < 900*time.Millisecond {
+		t.Errorf("Got an unexpected expiration: %s", expiration)
+	}
+
+	if expiration := c.getExpiration(context.Background()); expiration != time.Minute {
+		t.Errorf("Got an unexpected expiration: %s", expiration)
+	}
+}
+
+func TestFormatExpiration(t *testing.T) {
+	if expiration := formatExpiration(1500 * time.Millisecond); expiration != "1500" {
+		t.Errorf("Got an unexpected expiration: %s", expiration)
+	}
+
+	if expiration := formatExpiration(-time.Second); expiration != "1" {
+		t.Errorf("Got an unexpected expiration: %s", expiration)
+	}
+}
+
+func TestCallWithCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c := newCall(&Client{defaultTTL: time.Second}, "doSomething")
+
+	if _, err := c.SyncContext(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+
+	if err := c.VoidContext(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestCallWithHeader(t *testing.T) {
+	c := newCall(&Client{serviceName: "service"}, "doSomething").WithHeader("X-Tenant", "acme")
+
+	headers := c.invocation(false).publishingHeaders(time.Now())
+
+	if headers["X-Tenant"] != "acme" {
+		t.Errorf("Got an unexpected header: %v", headers["X-Tenant"])
+	}
+
+	if headers["X-Method"] != "doSomething" {
+		t.Errorf("Got an unexpected method header: %v", headers["X-Method"])
+	}
+}
@@ -0,0 +1,118 @@
+package porthos
+
+import (
+	"context"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// DefaultPublishChannels is the default number of publishing channels kept by a broker.
+const DefaultPublishChannels = 8
+
+// channelPool keeps confirm mode channels open, so publishing does not cost a channel
+// open/close round trip. The channels are shared by the publishers in a round-robin
+// fashion, opened on demand and replaced when they fail.
+type channelPool struct {
+	m          sync.Mutex
+	open       func() (Channel, error)
+	channels   []*confirmChannel
+	next       int
+	generation int
+}
+
+func newChannelPool(size int, open func() (Channel, error)) *channelPool {
+	if size <= 0 {
+		size = DefaultPublishChannels
+	}
+
+	return &channelPool{open: open, channels: make([]*confirmChannel, size)}
+}
+
+// publish sends the message on a pooled channel and waits for the broker confirmation.
+func (p *channelPool) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	ch, err := p.get()
+
+	if err != nil {
+		return err
+	}
+
+	return ch.publish(ctx, exchange, key, msg)
+}
+
+func (p *channelPool) get() (*confirmChannel, error) {
+	for {
+		p.m.Lock()
+		i := p.next
+		p.next = (p.next + 1) % len(p.channels)
+		ch := p.channels[i]
+		generation := p.generation
+		p.m.Unlock()
+
+		if ch != nil && !ch.isClosed() {
+			return ch, nil
+		}
+
+		// the channel is opened without holding the lock, the connection may be replaced meanwhile.
+		ch, err := p.openChannel()
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.m.Lock()
+
+		if p.generation != generation {
+			p.m.Unlock()
+			ch.Close()
+
+			continue
+		}
+
+		if current := p.channels[i]; current != nil && !current.isClosed() {
+			// another publisher replaced it first.
+			p.m.Unlock()
+			ch.Close()
+
+			return current, nil
+		}
+
+		p.channels[i] = ch
+		p.m.Unlock()
+
+		return ch, nil
+	}
+}
+
+func (p *channelPool) openChannel() (*confirmChannel, error) {
+	ch, err := p.open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := newConfirmChannel(ch)
+
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return cc, nil
+}
+
+// reset closes all the channels, failing their pending publishes.
+// It must be called whenever the connection is replaced.
+func (p *channelPool) reset() {
+	p.m.Lock()
+	channels := p.channels
+	p.channels = make([]*confirmChannel, len(channels))
+	p.generation++
+	p.m.Unlock()
+
+	for _, ch := range channels {
+		if ch != nil {
+			ch.Close()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package porthos
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelPoolRoundRobin(t *testing.T) {
+	b := newMemoryBroker(t, NewMemoryTransport())
+	defer b.Close()
+
+	pool := newChannelPool(2, b.openChannel)
+
+	first, err := pool.get()
+	assert.Nil(t, err)
+
+	second, err := pool.get()
+	assert.Nil(t, err)
+
+	assert.NotEqual(t, first, second)
+
+	again, _ := pool.get()
+	assert.Equal(t, first, again, "Channels must be shared in a round-robin fashion.")
+}
+
+func TestChannelPoolReplacesClosedChannels(t *testing.T) {
+	b := newMemoryBroker(t, NewMemoryTransport())
+	defer b.Close()
+
+	pool := newChannelPool(1, b.openChannel)
+
+	first, _ := pool.get()
+	first.Close()
+
+	// wait for the closed confirms to be noticed.
+	for !first.isClosed() {
+		time.Sleep(time.Millisecond)
+	}
+
+	second, err := pool.get()
+
+	if assert.Nil(t, err) {
+		assert.NotEqual(t, first, second)
+		assert.Nil(t, pool.publish(context.Background(), "", "test", amqp.Publishing{}))
+	}
+}
+
+func TestChannelPoolReconnection(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	b := newMemoryBroker(t, transport)
+	defer b.Close()
+
+	assert.Nil(t, b.publish(context.Background(), "", "test", amqp.Publishing{}))
+
+	rs := b.NotifyReestablish()
+
+	transport.Disconnect()
+
+	select {
+	case <-rs:
+	case <-time.After(time.Second):
+		t.Fatal("Connection not reestablished. Timedout.")
+	}
+
+	assert.Nil(t, b.publish(context.Background(), "", "test", amqp.Publishing{}))
+}
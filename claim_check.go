@@ -0,0 +1,191 @@
+package porthos
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	ErrNoBlobStore    = errors.New("Message body offloaded but no blob store configured.")
+	ErrBlobNotFound   = errors.New("Blob not found.")
+	ErrInvalidBlobRef = errors.New("Invalid blob reference.")
+)
+
+// ClaimCheckHeader is the message header carrying the reference of a body offloaded to the blob store.
+const ClaimCheckHeader = "X-Claim-Check"
+
+// BlobStore keeps the message bodies offloaded by the claim-check mode.
+// Clients and servers exchanging offloaded bodies must share the same store.
+type BlobStore interface {
+	// Put stores the body and returns its reference.
+	Put(ctx context.Context, body []byte) (string, error)
+	// Get returns the body of the reference, or ErrBlobNotFound.
+	Get(ctx context.Context, ref string) ([]byte, error)
+	// Delete removes the body of the reference. Deleting a missing one is not an error.
+	Delete(ctx context.Context, ref string) error
+}
+
+// ClaimCheck configures the offloading of large bodies: they are put in the Store
+// and only their reference travels in the message.
+type ClaimCheck struct {
+	// Store of the offloaded bodies, nil disables the offloading.
+	// It is also used to resolve the offloaded bodies received.
+	Store BlobStore
+	// Threshold is the size in bytes over which the bodies are offloaded.
+	Threshold int
+}
+
+// offload puts the body of the message in the store if it is over the threshold,
+// replacing it by its reference.
+func (c ClaimCheck) offload(ctx context.Context, msg *amqp.Publishing) error {
+	if c.Store == nil || len(msg.Body) <= c.Threshold {
+		return nil
+	}
+
+	ref, err := c.Store.Put(ctx, msg.Body)
+
+	if err != nil {
+		return err
+	}
+
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+
+	msg.Headers[ClaimCheckHeader] = ref
+	msg.Body = nil
+
+	return nil
+}
+
+// publish offloads the body of the message if needed and publishes it.
+// The offloaded body is deleted if the publish fails, nobody would claim it.
+func (c ClaimCheck) publish(ctx context.Context, p publisher, exchange, key string, msg amqp.Publishing) error {
+	if err := c.offload(ctx, &msg); err != nil {
+		return err
+	}
+
+	err := p.publish(ctx, exchange, key, msg)
+
+	if err != nil {
+		// the context may be done already.
+		c.release(context.Background(), msg.Headers)
+	}
+
+	return err
+}
+
+// resolve returns the body of a message, getting it from the store if it was offloaded.
+func (c ClaimCheck) resolve(ctx context.Context, headers amqp.Table, body []byte) ([]byte, error) {
+	ref, ok := headers[ClaimCheckHeader].(string)
+
+	if !ok {
+		return body, nil
+	}
+
+	if c.Store == nil {
+		return nil, ErrNoBlobStore
+	}
+
+	return c.Store.Get(ctx, ref)
+}
+
+// release deletes the offloaded body of a message, once it is no longer needed.
+func (c ClaimCheck) release(ctx context.Context, headers amqp.Table) {
+	ref, ok := headers[ClaimCheckHeader].(string)
+
+	if !ok || c.Store == nil {
+		return
+	}
+
+	if err := c.Store.Delete(ctx, ref); err != nil {
+		log.Printf("[PORTHOS] Error deleting blob %s: %s", ref, err)
+	}
+}
+
+// FileBlobStore is a BlobStore keeping the bodies as files of a local directory,
+// which may be a shared volume when clients and servers run on different hosts.
+// Bodies of messages that are never consumed (e.g. expired ones) are left behind.
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore creates a FileBlobStore, creating the directory if needed.
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileBlobStore{dir: dir}, nil
+}
+
+// Put writes the body to a new file, named after its reference.
+func (s *FileBlobStore) Put(ctx context.Context, body []byte) (string, error) {
+	ref, err := NewUUIDv4()
+
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(s.dir, ref)
+
+	// written aside and renamed, so readers never see a partial body.
+	if err := ioutil.WriteFile(path+".tmp", body, 0600); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+
+	return ref, nil
+}
+
+// Get reads the file of the reference.
+func (s *FileBlobStore) Get(ctx context.Context, ref string) ([]byte, error) {
+	path, err := s.path(ref)
+
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+
+	return body, err
+}
+
+// Delete removes the file of the reference.
+func (s *FileBlobStore) Delete(ctx context.Context, ref string) error {
+	path, err := s.path(ref)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// path returns the file of the reference, rejecting references outside the directory.
+func (s *FileBlobStore) path(ref string) (string, error) {
+	if ref == "" || ref == "." || ref == ".." || strings.ContainsAny(ref, `/\`) {
+		return "", ErrInvalidBlobRef
+	}
+
+	return filepath.Join(s.dir, ref), nil
+}
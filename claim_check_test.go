@@ -0,0 +1,126 @@
+package porthos
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFileBlobStore(t *testing.T) (*FileBlobStore, func()) {
+	dir, err := ioutil.TempDir("", "porthos-blobs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileBlobStore(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, func() { os.RemoveAll(dir) }
+}
+
+// countBlobs returns the number of files in the store directory.
+func countBlobs(t *testing.T, store *FileBlobStore) int {
+	files, err := ioutil.ReadDir(store.dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(files)
+}
+
+func TestFileBlobStore(t *testing.T) {
+	store, cleanup := newTestFileBlobStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	ref, err := store.Put(ctx, []byte("body"))
+
+	if assert.Nil(t, err) {
+		body, err := store.Get(ctx, ref)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("body"), body)
+
+		assert.Nil(t, store.Delete(ctx, ref))
+		assert.Nil(t, store.Delete(ctx, ref))
+
+		_, err = store.Get(ctx, ref)
+		assert.Equal(t, ErrBlobNotFound, err)
+	}
+
+	for _, ref := range []string{"", "..", "../x", `a\b`} {
+		_, err := store.Get(ctx, ref)
+		assert.Equal(t, ErrInvalidBlobRef, err, ref)
+	}
+}
+
+func TestClaimCheckOffload(t *testing.T) {
+	store, cleanup := newTestFileBlobStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	claimCheck := ClaimCheck{Store: store, Threshold: 4}
+
+	msg := amqp.Publishing{Body: []byte("abcd")}
+
+	assert.Nil(t, claimCheck.offload(ctx, &msg))
+	assert.Equal(t, []byte("abcd"), msg.Body)
+	assert.Nil(t, msg.Headers)
+
+	msg = amqp.Publishing{Body: []byte("abcde")}
+
+	assert.Nil(t, claimCheck.offload(ctx, &msg))
+	assert.Nil(t, msg.Body)
+	assert.Contains(t, msg.Headers, ClaimCheckHeader)
+
+	body, err := claimCheck.resolve(ctx, msg.Headers, msg.Body)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abcde"), body)
+
+	_, err = ClaimCheck{}.resolve(ctx, msg.Headers, msg.Body)
+	assert.Equal(t, ErrNoBlobStore, err)
+
+	claimCheck.release(ctx, msg.Headers)
+	assert.Equal(t, 0, countBlobs(t, store))
+}
+
+// failingPublisher fails every publish with its error.
+type failingPublisher struct {
+	err error
+}
+
+func (p failingPublisher) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	return p.err
+}
+
+func TestClaimCheckPublishFailure(t *testing.T) {
+	store, cleanup := newTestFileBlobStore(t)
+	defer cleanup()
+
+	rw := &responseWriter{
+		publisher:  failingPublisher{err: ErrNotAcked},
+		autoAck:    true,
+		claimCheck: ClaimCheck{Store: store, Threshold: 4},
+		delivery: amqp.Delivery{
+			ReplyTo:       "reply",
+			CorrelationId: "correlationId",
+		},
+	}
+
+	response := newResponse()
+	response.Raw(StatusOK, "text/plain", []byte("large response"))
+
+	assert.Equal(t, ErrNotAcked, rw.Write(response))
+	assert.Equal(t, 0, countBlobs(t, store), "The offloaded body must be deleted.")
+}
@@ -1,8 +1,10 @@
 package porthos
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,62 +20,205 @@ type Client struct {
 	responseQueueName string
 
 	slots    map[string]*slot
+	streams  map[string]*ClientStream
 	slotLock sync.Mutex
 
-	m      sync.Mutex
-	closed bool
+	interceptors     []Interceptor
+	interceptorsLock sync.Mutex
+
+	contentType string
+	accept      string
+	compression Compression
+	claimCheck  ClaimCheck
+
+	streamWindow int
+
+	directReplyTo bool
+	replyChannel  *confirmChannel
+
+	m       sync.Mutex
+	channel Channel
+	stop    chan struct{}
+	closed  bool
+	err     error
 }
 
+// ClientOptions represent all the options supported by the client.
+type ClientOptions struct {
+	// DefaultTTL is the timeout of the calls that don't define their own.
+	DefaultTTL time.Duration
+	// DirectReplyTo receives the responses through the RabbitMQ direct reply-to
+	// pseudo-queue (amq.rabbitmq.reply-to) instead of declaring a response queue.
+	DirectReplyTo bool
+	// ContentType of the bodies set by WithArgs, WithMap and WithStruct, defaults to application/json.
+	// It must have a registered codec (see RegisterCodec).
+	ContentType string
+	// Accept lists the content types accepted in the responses, in order of preference.
+	// Defaults to the ContentType. They must have a registered codec.
+	Accept []string
+	// Compression of the request bodies, disabled by default. Its MaxDecodedSize limits
+	// the decompressed response bodies.
+	Compression Compression
+	// ClaimCheck offloads the large request bodies and resolves the offloaded response ones.
+	ClaimCheck ClaimCheck
+	// StreamWindow is the number of chunks of a stream the server may send ahead of the ones
+	// read by the caller, defaults to DefaultStreamWindow.
+	StreamWindow int
+}
+
+// directReplyToQueue is the RabbitMQ pseudo-queue used for direct reply-to.
+const directReplyToQueue = "amq.rabbitmq.reply-to"
+
 func newUniqueQueueName(prefix string) string {
 	return fmt.Sprintf("%s@%d-porthos", prefix, time.Now().UnixNano())
 }
 
 // NewClient creates a new instance of Client, responsible for making remote calls.
 func NewClient(b *Broker, serviceName string, defaultTTL time.Duration) (*Client, error) {
+	return NewClientWithOptions(b, serviceName, ClientOptions{DefaultTTL: defaultTTL})
+}
+
+// NewClientWithOptions creates a new instance of Client with the given options.
+func NewClientWithOptions(b *Broker, serviceName string, options ClientOptions) (*Client, error) {
+	if options.ContentType == "" {
+		options.ContentType = ContentTypeJSON
+	}
+
+	if len(options.Accept) == 0 {
+		options.Accept = []string{options.ContentType}
+	}
+
+	if err := options.Compression.validate(); err != nil {
+		return nil, err
+	}
+
+	for _, contentType := range append([]string{options.ContentType}, options.Accept...) {
+		if _, err := codecFor(contentType); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.StreamWindow <= 0 {
+		options.StreamWindow = DefaultStreamWindow
+	}
+
 	c := &Client{
-		serviceName:       serviceName,
-		defaultTTL:        defaultTTL,
-		broker:            b,
-		slots:             make(map[string]*slot, 3000),
-		responseQueueName: newUniqueQueueName(serviceName),
+		serviceName:   serviceName,
+		defaultTTL:    options.DefaultTTL,
+		broker:        b,
+		slots:         make(map[string]*slot, 3000),
+		streams:       make(map[string]*ClientStream),
+		directReplyTo: options.DirectReplyTo,
+		contentType:   options.ContentType,
+		accept:        strings.Join(options.Accept, ", "),
+		compression:   options.Compression,
+		claimCheck:    options.ClaimCheck,
+		streamWindow:  options.StreamWindow,
+		stop:          make(chan struct{}),
+	}
+
+	if !c.directReplyTo {
+		c.responseQueueName = newUniqueQueueName(serviceName)
 	}
 
-	go c.start()
+	// the response queue must exist before the first call is made.
+	ch, dc, err := c.consume()
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.channel = ch
+
+	go c.start(ch, dc)
 
 	return c, nil
 }
 
-func (c *Client) start() {
+func (c *Client) start(ch Channel, dc <-chan amqp.Delivery) {
 	rs := c.broker.NotifyReestablish()
+	defer c.broker.StopNotifyReestablish(rs)
+
+	for {
+		for d := range dc {
+			c.processResponse(d)
+		}
+
+		ch.Close()
+		log.Print("[PORTHOS] Consuming stopped.")
 
-	for !c.closed {
+		ch, dc = c.reconsume(rs)
+
+		if dc == nil {
+			return
+		}
+	}
+}
+
+// reconsume consumes the responses again, retrying according to the broker backoff.
+// It gives up when the retries are exhausted or the broker stops, making the following calls fail.
+func (c *Client) reconsume(rs <-chan bool) (Channel, <-chan amqp.Delivery) {
+	backoff := c.broker.config.Backoff
+
+	for attempt := 0; !c.isClosed(); {
 		if !c.broker.IsConnected() {
 			log.Printf("[PORTHOS] Connection not established. Waiting connection to be reestablished.")
 
-			<-rs
+			select {
+			case <-rs:
+			case <-c.broker.Done():
+				c.setErr(c.broker.Err())
+				return nil, nil
+			case <-c.stop:
+				return nil, nil
+			}
 
 			continue
 		}
 
-		err := c.consume()
+		ch, dc, err := c.consume()
 
-		if err != nil {
-			log.Printf("[PORTHOS] Error consuming responses. Error: %s", err)
-			time.Sleep(5 * time.Second)
-		} else {
-			log.Print("[PORTHOS] Consuming stopped.")
+		if err == nil {
+			if !c.setChannel(ch) {
+				ch.Close()
+				return nil, nil
+			}
+
+			return ch, dc
+		}
+
+		attempt++
+
+		if backoff.Exhausted(attempt) {
+			log.Printf("[PORTHOS] Error consuming responses, attempt %d. Giving up. Error: %s", attempt, err)
+
+			c.setErr(ErrRetriesExhausted)
+			return nil, nil
+		}
+
+		log.Printf("[PORTHOS] Error consuming responses, attempt %d. Error: %s", attempt, err)
+
+		select {
+		case <-rs:
+		case <-c.broker.Done():
+		case <-c.stop:
+		case <-time.After(backoff.Delay(attempt - 1)):
 		}
 	}
+
+	return nil, nil
 }
 
-func (c *Client) consume() error {
+func (c *Client) consume() (Channel, <-chan amqp.Delivery, error) {
 	ch, err := c.broker.openChannel()
 
 	if err != nil {
-		return errors.Wrap(err, "failed to open channel")
+		return nil, nil, errors.Wrap(err, "failed to open channel")
 	}
 
-	defer ch.Close()
+	if c.directReplyTo {
+		return c.consumeDirectReplyTo(ch)
+	}
 
 	// create the response queue
 	_, err = ch.QueueDeclare(
@@ -86,7 +231,8 @@ func (c *Client) consume() error {
 	)
 
 	if err != nil {
-		return errors.Wrap(err, "failed to declare queue")
+		ch.Close()
+		return nil, nil, errors.Wrap(err, "failed to declare queue")
 	}
 
 	dc, err := ch.Consume(
@@ -100,45 +246,192 @@ func (c *Client) consume() error {
 	)
 
 	if err != nil {
-		return errors.Wrap(err, "failed to consume queue")
+		ch.Close()
+		return nil, nil, errors.Wrap(err, "failed to consume queue")
+	}
+
+	return ch, dc, nil
+}
+
+// consumeDirectReplyTo consumes the direct reply-to pseudo-queue.
+// The channel is also used to publish the requests, as required by RabbitMQ.
+func (c *Client) consumeDirectReplyTo(ch Channel) (Channel, <-chan amqp.Delivery, error) {
+	rc, err := newConfirmChannel(ch)
+
+	if err != nil {
+		ch.Close()
+		return nil, nil, err
 	}
 
-	for d := range dc {
-		c.processResponse(d)
+	dc, err := ch.Consume(
+		directReplyToQueue, // queue
+		"",                 // consumer
+		true,               // auto-ack
+		false,              // exclusive
+		false,              // no-local
+		false,              // no-wait
+		nil,                // args
+	)
+
+	if err != nil {
+		ch.Close()
+		return nil, nil, errors.Wrap(err, "failed to consume direct reply-to")
 	}
 
-	return nil
+	c.m.Lock()
+	c.replyChannel = rc
+	c.m.Unlock()
+
+	return ch, dc, nil
+}
+
+// setChannel keeps the consumer channel to be closed by Close, false if the client is already closed.
+func (c *Client) setChannel(ch Channel) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		c.replyChannel = nil
+		return false
+	}
+
+	c.channel = ch
+
+	return true
+}
+
+func (c *Client) getReplyChannel() *confirmChannel {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.replyChannel
+}
+
+// replyTo returns where the server must send the responses to.
+func (c *Client) replyTo() string {
+	if c.directReplyTo {
+		return directReplyToQueue
+	}
+
+	return c.responseQueueName
 }
 
 func (c *Client) processResponse(d amqp.Delivery) {
-	d.Ack(false)
+	// direct reply-to responses are consumed in auto-ack mode.
+	if !c.directReplyTo {
+		d.Ack(false)
+	}
 
 	statusCode := d.Headers["statusCode"].(int32)
 
-	res, ok := c.popSlot(d.CorrelationId)
-	if ok {
-		res.sendResponse(ClientResponse{
-			Content:     d.Body,
-			ContentType: d.ContentType,
-			StatusCode:  statusCode,
-			Headers:     *NewHeadersFromMap(d.Headers),
-		})
-	} else {
+	body, err := c.claimCheck.resolve(context.Background(), d.Headers, d.Body)
+
+	// the response is consumed, its offloaded body is no longer needed.
+	c.claimCheck.release(context.Background(), d.Headers)
+
+	if err == nil {
+		body, err = c.compression.decompress(d.ContentEncoding, body)
+	}
+
+	response := ClientResponse{
+		Content:     body,
+		ContentType: d.ContentType,
+		StatusCode:  statusCode,
+		Headers:     *NewHeadersFromMap(d.Headers),
+	}
+
+	if err != nil {
+		log.Printf("[PORTHOS] Error reading response %s: %s", d.CorrelationId, err)
+
+		// the caller gets an error instead of waiting until it times out.
+		errRes := newErrorResponse(NewRPCError(StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("Invalid response body: %s", err)))
+
+		response.StatusCode = errRes.GetStatusCode()
+		response.Content = errRes.GetBody()
+		response.ContentType = errRes.GetContentType()
+	}
+
+	if stream, ok := c.getStream(d.CorrelationId); ok {
+		stream.deliver(response)
+	} else if res, ok := c.popSlot(d.CorrelationId); ok {
+		res.sendResponse(response)
+	} else if control, ok := d.Headers[streamControlHeader].(string); ok {
+		// a chunk of a stream closed by the caller, or read as a single response.
+		if _, ok := d.Headers[streamSeqHeader]; ok {
+			c.cancelStream(control, d.CorrelationId)
+		}
+	} else if _, ok := d.Headers[streamEndHeader]; !ok {
 		log.Printf("[PORTHOS] Slot %s not exists.", d.CorrelationId)
 	}
 }
 
+// Use adds interceptors wrapping all the outgoing calls of this client.
+// Calls already in progress keep the interceptors they started with.
+func (c *Client) Use(interceptors ...Interceptor) {
+	c.interceptorsLock.Lock()
+	defer c.interceptorsLock.Unlock()
+
+	// copied, so the slices returned by getInterceptors are never modified.
+	c.interceptors = append(c.interceptors[:len(c.interceptors):len(c.interceptors)], interceptors...)
+}
+
+func (c *Client) getInterceptors() []Interceptor {
+	c.interceptorsLock.Lock()
+	defer c.interceptorsLock.Unlock()
+
+	return c.interceptors
+}
+
+func (c *Client) intercept(ctx context.Context, inv *Invocation, invoker Invoker) (*ClientResponse, error) {
+	return chainInterceptors(c.getInterceptors(), invoker)(ctx, inv)
+}
+
 // Call prepares a remote call.
 func (c *Client) Call(method string) *call {
 	return newCall(c, method)
 }
 
 // Close the client and AMQP chanel.
-// Client only will die if broker was closed.
+// The responses are no longer consumed, the pending calls time out.
 func (c *Client) Close() {
 	c.m.Lock()
 	defer c.m.Unlock()
+
+	if c.closed {
+		return
+	}
+
 	c.closed = true
+	c.replyChannel = nil
+	close(c.stop)
+
+	if c.channel != nil {
+		// stops the deliveries, making the consumer goroutine return.
+		c.channel.Close()
+	}
+}
+
+// Err returns the error that made the client stop receiving responses, nil while it is running.
+// Calls fail with this error as well.
+func (c *Client) Err() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.err
+}
+
+func (c *Client) setErr(err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.err = err
+}
+
+func (c *Client) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.closed
 }
 
 func (c *Client) pushSlot(correlationID string, slot *slot) {
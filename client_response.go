@@ -23,6 +23,11 @@ func (r *ClientResponse) UnmarshalJSONTo(v interface{}) error {
 	return err
 }
 
+// Decode decodes the response content into the argument pointer, using the codec of the response content type.
+func (r *ClientResponse) Decode(v interface{}) error {
+	return Unmarshal(r.ContentType, r.Content, v)
+}
+
 // UnmarshalJSON outputs the response content to the argument pointer.
 func (r *ClientResponse) UnmarshalJSON() (map[string]interface{}, error) {
 	if r.ContentType != "application/json" {
@@ -34,3 +39,22 @@ func (r *ClientResponse) UnmarshalJSON() (map[string]interface{}, error) {
 
 	return v, err
 }
+
+// Err returns the error of the response as an *RPCError, or nil if its status code is not
+// an error one (4xx or 5xx).
+func (r *ClientResponse) Err() error {
+	if r.StatusCode < StatusBadRequest {
+		return nil
+	}
+
+	return decodeRPCError(r.StatusCode, r.ContentType, r.Content)
+}
+
+// isMethodNotFound tells whether the server replied that the called method does not exist.
+func (r *ClientResponse) isMethodNotFound() bool {
+	if r.StatusCode != StatusNotFound {
+		return false
+	}
+
+	return decodeRPCError(r.StatusCode, r.ContentType, r.Content).Code == ErrorCodeMethodNotFound
+}
@@ -73,3 +73,22 @@ func TestUnmarshalJSONInvalidContentType(t *testing.T) {
 		t.Error("Content type error was expected")
 	}
 }
+
+func TestClientResponseErr(t *testing.T) {
+	ok := ClientResponse{StatusCode: StatusOK}
+
+	if err := ok.Err(); err != nil {
+		t.Errorf("Expected no error, got: %s", err)
+	}
+
+	notEnvelope := ClientResponse{StatusCode: StatusServiceUnavailable, ContentType: "text/plain", Content: []byte("down")}
+	err, isRPCError := notEnvelope.Err().(*RPCError)
+
+	if !isRPCError {
+		t.Fatalf("Expected an *RPCError, got: %v", notEnvelope.Err())
+	}
+
+	if err.StatusCode != StatusServiceUnavailable || err.Code != ErrorCodeUnknown {
+		t.Errorf("Expected an unknown error with status 503, got: %s", err)
+	}
+}
@@ -0,0 +1,242 @@
+package porthos
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ClientStream iterates over the chunks of a streaming response, see call.StreamContext.
+//
+//     stream, err := client.Call("list").Stream()
+//     defer stream.Close()
+//
+//     for stream.Next() {
+//         err := stream.Chunk().Decode(&item)
+//     }
+//
+//     err = stream.Err()
+type ClientStream struct {
+	client   *Client
+	id       string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	window   int
+	messages chan streamMessage
+
+	// only used by the goroutine iterating.
+	seq      int64
+	consumed int
+	chunk    *ClientResponse
+
+	m          sync.Mutex
+	control    string
+	ended      bool
+	overflowed bool
+	err        error
+}
+
+// streamMessage is a chunk, or the response ending the stream.
+type streamMessage struct {
+	response ClientResponse
+	seq      int64
+	end      bool
+}
+
+func newClientStream(ctx context.Context, client *Client, id string, window int, timeout time.Duration) *ClientStream {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	return &ClientStream{
+		client: client,
+		id:     id,
+		ctx:    ctx,
+		cancel: cancel,
+		window: window,
+		// the server never sends more chunks than granted, plus the end of the stream.
+		messages: make(chan streamMessage, window+1),
+	}
+}
+
+// Next waits for the next chunk, returning false when the stream ends,
+// fails or its context is done. See Chunk and Err.
+func (s *ClientStream) Next() bool {
+	s.chunk = nil
+
+	if s.isEnded() {
+		return false
+	}
+
+	select {
+	case msg := <-s.messages:
+		if s.isOverflowed() {
+			s.finish(ErrStreamOverflow, true)
+			return false
+		}
+
+		if msg.end {
+			s.finish(msg.response.Err(), false)
+			return false
+		}
+
+		if msg.seq != s.seq {
+			s.finish(ErrStreamOutOfOrder, true)
+			return false
+		}
+
+		s.seq++
+		s.chunk = &msg.response
+
+		if err := s.consume(); err != nil {
+			s.finish(err, true)
+			return false
+		}
+
+		return true
+	case <-s.ctx.Done():
+		s.finish(contextError(s.ctx.Err()), true)
+		return false
+	}
+}
+
+// Chunk returns the chunk read by the last call to Next.
+func (s *ClientStream) Chunk() *ClientResponse {
+	return s.chunk
+}
+
+// Err returns the error that ended the stream: the error replied by the server (see ClientResponse.Err),
+// ErrTimedOut or the context error. It returns nil if the stream ended successfully or was closed.
+func (s *ClientStream) Err() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.err
+}
+
+// Close cancels the stream if it has not ended yet. It may be called while another goroutine waits in Next.
+func (s *ClientStream) Close() error {
+	s.finish(nil, true)
+	return nil
+}
+
+// consume accounts the chunk read, granting more credit to the server every half window.
+func (s *ClientStream) consume() error {
+	s.consumed++
+
+	if s.consumed < (s.window+1)/2 {
+		return nil
+	}
+
+	credit := s.consumed
+	s.consumed = 0
+
+	return s.client.sendStreamControl(s.ctx, s.getControl(), s.id, amqp.Table{streamCreditHeader: int32(credit)})
+}
+
+// finish ends the stream with the error, if it has not ended yet, canceling it on the server if requested.
+func (s *ClientStream) finish(err error, cancel bool) {
+	s.m.Lock()
+
+	if s.ended {
+		s.m.Unlock()
+		return
+	}
+
+	s.ended = true
+	s.err = err
+	control := s.control
+	s.m.Unlock()
+
+	s.client.popStream(s.id)
+	s.cancel()
+
+	// without the control queue, the server is canceled when its first chunk arrives.
+	if cancel && control != "" {
+		s.client.cancelStream(control, s.id)
+	}
+}
+
+func (s *ClientStream) isEnded() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.ended
+}
+
+func (s *ClientStream) isOverflowed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.overflowed
+}
+
+func (s *ClientStream) getControl() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.control
+}
+
+// deliver queues a response of the stream, called by the client consumer.
+func (s *ClientStream) deliver(response ClientResponse) {
+	seq, chunk := response.Headers.Get(streamSeqHeader).(int64)
+
+	if chunk {
+		if control, ok := response.Headers.Get(streamControlHeader).(string); ok {
+			s.m.Lock()
+			s.control = control
+			s.m.Unlock()
+		}
+	}
+
+	select {
+	case s.messages <- streamMessage{response: response, seq: seq, end: !chunk}:
+	default:
+		// the buffer is full, so Next notices it right away.
+		s.m.Lock()
+		s.overflowed = true
+		s.m.Unlock()
+	}
+}
+
+func (c *Client) pushStream(id string, s *ClientStream) {
+	c.slotLock.Lock()
+	defer c.slotLock.Unlock()
+
+	c.streams[id] = s
+}
+
+func (c *Client) popStream(id string) {
+	c.slotLock.Lock()
+	defer c.slotLock.Unlock()
+
+	delete(c.streams, id)
+}
+
+func (c *Client) getStream(id string) (*ClientStream, bool) {
+	c.slotLock.Lock()
+	defer c.slotLock.Unlock()
+
+	s, ok := c.streams[id]
+
+	return s, ok
+}
+
+// cancelStream tells the server to stop streaming, in background.
+func (c *Client) cancelStream(control, id string) {
+	go func() {
+		if err := c.sendStreamControl(context.Background(), control, id, amqp.Table{streamCancelHeader: true}); err != nil {
+			log.Printf("[PORTHOS] Error canceling stream %s: %s", id, err)
+		}
+	}()
+}
+
+// sendStreamControl publishes a control message of the stream to the server.
+func (c *Client) sendStreamControl(ctx context.Context, control, id string, headers amqp.Table) error {
+	return c.broker.publish(ctx, "", control, amqp.Publishing{
+		Headers:       headers,
+		CorrelationId: id,
+	})
+}
@@ -0,0 +1,70 @@
+package porthos
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClientStream(window int, timeout time.Duration) *ClientStream {
+	client := &Client{streams: make(map[string]*ClientStream)}
+	stream := newClientStream(context.Background(), client, "id", window, timeout)
+
+	client.pushStream("id", stream)
+
+	return stream
+}
+
+func chunkResponse(seq int64) ClientResponse {
+	headers := NewHeaders()
+	headers.Set(streamSeqHeader, seq)
+
+	return ClientResponse{StatusCode: StatusOK, Headers: *headers}
+}
+
+func TestClientStreamOutOfOrder(t *testing.T) {
+	stream := newTestClientStream(16, time.Second)
+
+	stream.deliver(chunkResponse(0))
+	stream.deliver(chunkResponse(2))
+
+	assert.True(t, stream.Next())
+	assert.False(t, stream.Next())
+	assert.Equal(t, ErrStreamOutOfOrder, stream.Err())
+
+	_, ok := stream.client.getStream("id")
+	assert.False(t, ok)
+}
+
+func TestClientStreamOverflow(t *testing.T) {
+	stream := newTestClientStream(1, time.Second)
+
+	stream.deliver(chunkResponse(0))
+	stream.deliver(chunkResponse(1))
+	stream.deliver(chunkResponse(2))
+
+	assert.False(t, stream.Next())
+	assert.Equal(t, ErrStreamOverflow, stream.Err())
+}
+
+func TestClientStreamEnd(t *testing.T) {
+	stream := newTestClientStream(16, time.Second)
+
+	stream.deliver(chunkResponse(0))
+	stream.deliver(ClientResponse{StatusCode: StatusOK, Headers: *NewHeaders()})
+
+	assert.True(t, stream.Next())
+	assert.NotNil(t, stream.Chunk())
+	assert.False(t, stream.Next())
+	assert.Nil(t, stream.Chunk())
+	assert.Nil(t, stream.Err())
+}
+
+func TestClientStreamTimeout(t *testing.T) {
+	stream := newTestClientStream(16, 10*time.Millisecond)
+
+	assert.False(t, stream.Next())
+	assert.Equal(t, ErrTimedOut, stream.Err())
+}
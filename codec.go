@@ -0,0 +1,281 @@
+package porthos
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Content types of the built-in codecs.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeCBOR     = "application/cbor"
+	ContentTypeProtobuf = "application/protobuf"
+)
+
+// Codec encodes and decodes the bodies of a content type.
+type Codec interface {
+	// Marshal returns the encoding of v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into the value pointed by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecs     = make(map[string]Codec)
+	codecsLock sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(ContentTypeJSON, JSONCodec{})
+	RegisterCodec(ContentTypeMsgpack, MsgpackCodec{})
+	RegisterCodec("application/x-msgpack", MsgpackCodec{})
+	RegisterCodec(ContentTypeCBOR, CBORCodec{})
+	RegisterCodec(ContentTypeProtobuf, ProtobufCodec{})
+	RegisterCodec("application/x-protobuf", ProtobufCodec{})
+}
+
+// RegisterCodec registers the codec of a content type, replacing the previous one if any.
+// The codecs are shared by all the clients and servers of the process.
+func RegisterCodec(contentType string, codec Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	codecs[mediaType(contentType)] = codec
+}
+
+// LookupCodec returns the codec registered for the content type, ignoring its parameters (e.g. charset).
+func LookupCodec(contentType string) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	codec, ok := codecs[mediaType(contentType)]
+
+	return codec, ok
+}
+
+// codecFor returns the codec of the content type or an error if there's none.
+func codecFor(contentType string) (Codec, error) {
+	codec, ok := LookupCodec(contentType)
+
+	if !ok {
+		return nil, fmt.Errorf("Invalid content type, got: %s", contentType)
+	}
+
+	return codec, nil
+}
+
+// Marshal encodes v with the codec of the content type.
+func Marshal(contentType string, v interface{}) ([]byte, error) {
+	codec, err := codecFor(contentType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.Marshal(v)
+}
+
+// Unmarshal decodes data into v with the codec of the content type.
+func Unmarshal(contentType string, data []byte, v interface{}) error {
+	codec, err := codecFor(contentType)
+
+	if err != nil {
+		return err
+	}
+
+	return codec.Unmarshal(data, v)
+}
+
+// AcceptHeader is the request header listing the content types the caller accepts in the response,
+// in the HTTP format: "application/msgpack, application/json;q=0.5".
+const AcceptHeader = "Accept"
+
+// negotiate returns the content type of the best registered codec for the accept list,
+// preferring the given one when a wildcard matches it. An empty accept list accepts anything.
+func negotiate(accept string, preferred string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return preferred, true
+	}
+
+	for _, r := range parseAccept(accept) {
+		switch {
+		case r == "*/*":
+			return preferred, true
+		case strings.HasSuffix(r, "/*"):
+			if strings.HasPrefix(preferred, strings.TrimSuffix(r, "*")) {
+				return preferred, true
+			}
+
+			if contentType, ok := registeredWithPrefix(strings.TrimSuffix(r, "*")); ok {
+				return contentType, true
+			}
+		default:
+			if _, ok := LookupCodec(r); ok {
+				return r, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// parseAccept returns the media ranges of an accept list sorted by quality, dropping the unacceptable ones.
+func parseAccept(accept string) []string {
+	type mediaRange struct {
+		value   string
+		quality float64
+	}
+
+	var ranges []mediaRange
+
+	for _, part := range strings.Split(accept, ",") {
+		value, params, err := mime.ParseMediaType(part)
+
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+
+		if quality > 0 {
+			ranges = append(ranges, mediaRange{value, quality})
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].quality > ranges[j].quality
+	})
+
+	values := make([]string, len(ranges))
+
+	for i, r := range ranges {
+		values[i] = r.value
+	}
+
+	return values
+}
+
+// registeredWithPrefix returns the first, in alphabetical order, registered content type with the given prefix.
+func registeredWithPrefix(prefix string) (string, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	var found string
+
+	for contentType := range codecs {
+		if strings.HasPrefix(contentType, prefix) && (found == "" || contentType < found) {
+			found = contentType
+		}
+	}
+
+	return found, found != ""
+}
+
+// mediaType returns the content type without parameters, in lower case.
+func mediaType(contentType string) string {
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		return t
+	}
+
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// JSONCodec encodes bodies as JSON. Numbers are decoded into interface{} values as json.Number.
+type JSONCodec struct{}
+
+// Marshal implements Codec.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements Codec.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// MsgpackCodec encodes bodies as MessagePack. Struct fields are named after their json tags.
+type MsgpackCodec struct{}
+
+// Marshal implements Codec.
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements Codec.
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+// cborDecMode decodes maps into interface{} values as map[string]interface{}, like the other codecs.
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+// CBORCodec encodes bodies as CBOR. Struct fields are named after their cbor or json tags.
+type CBORCodec struct{}
+
+// Marshal implements Codec.
+func (CBORCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+// Unmarshal implements Codec.
+func (CBORCodec) Unmarshal(data []byte, v interface{}) error {
+	return cborDecMode.Unmarshal(data, v)
+}
+
+// ProtobufCodec encodes bodies as protocol buffers, values must be proto.Message.
+type ProtobufCodec struct{}
+
+// Marshal implements Codec.
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+
+	if !ok {
+		return nil, fmt.Errorf("Protobuf codec requires a proto.Message, got: %T", v)
+	}
+
+	return proto.Marshal(m)
+}
+
+// Unmarshal implements Codec.
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+
+	if !ok {
+		return fmt.Errorf("Protobuf codec requires a proto.Message, got: %T", v)
+	}
+
+	return proto.Unmarshal(data, m)
+}
@@ -0,0 +1,155 @@
+package porthos
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type codecPayload struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeMsgpack, ContentTypeCBOR} {
+		data, err := Marshal(contentType, codecPayload{Name: "x", Value: 10})
+
+		if assert.Nil(t, err, contentType) {
+			var out codecPayload
+
+			assert.Nil(t, Unmarshal(contentType, data, &out), contentType)
+			assert.Equal(t, codecPayload{Name: "x", Value: 10}, out, contentType)
+		}
+	}
+}
+
+func TestCodecsDecodeMapsWithStringKeys(t *testing.T) {
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeMsgpack, ContentTypeCBOR} {
+		data, _ := Marshal(contentType, codecPayload{Name: "x", Value: 10})
+
+		var out interface{}
+
+		if assert.Nil(t, Unmarshal(contentType, data, &out), contentType) {
+			m, ok := out.(map[string]interface{})
+
+			if assert.True(t, ok, contentType) {
+				assert.Equal(t, "x", m["name"], contentType)
+			}
+		}
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	data, err := Marshal(ContentTypeProtobuf, wrapperspb.String("hello"))
+
+	if assert.Nil(t, err) {
+		out := &wrapperspb.StringValue{}
+
+		assert.Nil(t, Unmarshal(ContentTypeProtobuf, data, out))
+		assert.Equal(t, "hello", out.GetValue())
+	}
+
+	_, err = Marshal(ContentTypeProtobuf, codecPayload{})
+	assert.NotNil(t, err)
+}
+
+func TestLookupCodec(t *testing.T) {
+	codec, ok := LookupCodec("Application/JSON; charset=utf-8")
+
+	assert.True(t, ok)
+	assert.Equal(t, JSONCodec{}, codec)
+
+	_, ok = LookupCodec("application/octet-stream")
+	assert.False(t, ok)
+
+	_, err := Marshal("application/octet-stream", "x")
+	assert.EqualError(t, err, "Invalid content type, got: application/octet-stream")
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec("application/vnd.test+json", JSONCodec{})
+
+	req := &request{contentType: "application/vnd.test+json", body: []byte(`{"name": "x"}`)}
+
+	var out codecPayload
+
+	assert.Nil(t, req.Bind(&out))
+	assert.Equal(t, "x", out.Name)
+}
+
+func TestFormWithMsgpack(t *testing.T) {
+	data, _ := Marshal(ContentTypeMsgpack, []interface{}{10, 2.5, "x"})
+
+	form, err := NewForm(ContentTypeMsgpack, data)
+
+	if assert.Nil(t, err) {
+		i, err := form.GetArg(0).AsInt()
+		assert.Nil(t, err)
+		assert.Equal(t, 10, i)
+
+		f, err := form.GetArg(1).AsFloat64()
+		assert.Nil(t, err)
+		assert.Equal(t, 2.5, f)
+
+		s, err := form.GetArg(2).AsString()
+		assert.Nil(t, err)
+		assert.Equal(t, "x", s)
+	}
+}
+
+func TestResponseEncodeLikeRequest(t *testing.T) {
+	res := newResponseTo(&request{contentType: ContentTypeCBOR})
+	res.Encode(StatusOK, codecPayload{Name: "x"})
+
+	assert.Equal(t, ContentTypeCBOR, res.GetContentType())
+
+	var out codecPayload
+
+	assert.Nil(t, Unmarshal(ContentTypeCBOR, res.GetBody(), &out))
+	assert.Equal(t, "x", out.Name)
+
+	res = newResponseTo(&request{contentType: "application/octet-stream"})
+	res.Encode(StatusOK, codecPayload{Name: "x"})
+
+	assert.Equal(t, ContentTypeJSON, res.GetContentType())
+}
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		accept   string
+		expected string
+		ok       bool
+	}{
+		{"", ContentTypeCBOR, true},
+		{"application/msgpack", ContentTypeMsgpack, true},
+		{"application/xml, application/msgpack", ContentTypeMsgpack, true},
+		{"application/json;q=0.5, application/msgpack", ContentTypeMsgpack, true},
+		{"application/msgpack;q=0, application/json", ContentTypeJSON, true},
+		{"*/*", ContentTypeCBOR, true},
+		{"application/*", ContentTypeCBOR, true},
+		{"application/xml", "", false},
+		{"text/*", "", false},
+	}
+
+	for _, c := range cases {
+		contentType, ok := negotiate(c.accept, ContentTypeCBOR)
+
+		assert.Equal(t, c.ok, ok, c.accept)
+		assert.Equal(t, c.expected, contentType, c.accept)
+	}
+}
+
+func TestResponseEncodeNotAcceptable(t *testing.T) {
+	req := &request{contentType: ContentTypeJSON, headers: NewHeaders()}
+	req.headers.Set(AcceptHeader, "application/xml")
+
+	res := newResponseTo(req)
+	res.Encode(StatusOK, codecPayload{Name: "x"})
+
+	assert.Equal(t, StatusNotAcceptable, res.GetStatusCode())
+
+	rpcErr := decodeRPCError(res.GetStatusCode(), res.GetContentType(), res.GetBody())
+	assert.Equal(t, ErrorCodeNotAcceptable, rpcErr.Code)
+}
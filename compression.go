@@ -0,0 +1,264 @@
+package porthos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings of the built-in compressors.
+const (
+	EncodingGzip   = "gzip"
+	EncodingZstd   = "zstd"
+	EncodingSnappy = "snappy"
+)
+
+// DefaultMaxDecodedSize is the default maximum size in bytes of the decompressed bodies.
+const DefaultMaxDecodedSize = 64 << 20
+
+// ErrDecodedSizeExceeded is returned when a received body decompresses to more than the maximum size.
+var ErrDecodedSizeExceeded = errors.New("Decompressed body exceeds the maximum size.")
+
+// AcceptEncodingHeader is the request header listing the content encodings the caller decodes,
+// in the HTTP format: "gzip, zstd;q=0.5". Servers only compress the responses of the callers accepting
+// their encoding. Porthos clients accept all the built-in encodings.
+const AcceptEncodingHeader = "Accept-Encoding"
+
+// builtinEncodings is the accept-encoding list of the porthos clients.
+var builtinEncodings = strings.Join([]string{EncodingGzip, EncodingZstd, EncodingSnappy}, ", ")
+
+// Compression configures the compression of the published bodies.
+// Received bodies are decompressed according to their content encoding whatever the encoding configured,
+// up to MaxDecodedSize.
+type Compression struct {
+	// Encoding of the compressed bodies: EncodingGzip, EncodingZstd or EncodingSnappy.
+	// Empty disables the compression.
+	Encoding string
+	// Threshold is the size in bytes from which the bodies are compressed, smaller ones are sent as is.
+	Threshold int
+	// MaxDecodedSize is the maximum size in bytes of the decompressed received bodies,
+	// defaults to DefaultMaxDecodedSize. Larger bodies fail with ErrDecodedSizeExceeded.
+	MaxDecodedSize int
+}
+
+type compressor struct {
+	compress func([]byte) ([]byte, error)
+	// decompress fails with ErrDecodedSizeExceeded past the maximum size.
+	decompress func(body []byte, maxSize int) ([]byte, error)
+}
+
+var compressors = map[string]compressor{
+	EncodingGzip:   {gzipCompress, gzipDecompress},
+	EncodingZstd:   {zstdCompress, zstdDecompress},
+	EncodingSnappy: {snappyCompress, snappyDecompress},
+}
+
+// validate checks that the encoding is supported.
+func (c Compression) validate() error {
+	if _, ok := compressors[c.Encoding]; c.Encoding != "" && !ok {
+		return fmt.Errorf("Invalid content encoding, got: %s", c.Encoding)
+	}
+
+	return nil
+}
+
+// compress returns the body compressed and its content encoding. Bodies under the threshold,
+// or that don't get smaller, are returned as is with an empty encoding.
+func (c Compression) compress(body []byte) ([]byte, string, error) {
+	comp, ok := compressors[c.Encoding]
+
+	if !ok || len(body) == 0 || len(body) < c.Threshold {
+		return body, "", nil
+	}
+
+	compressed, err := comp.compress(body)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(compressed) >= len(body) {
+		return body, "", nil
+	}
+
+	return compressed, c.Encoding, nil
+}
+
+// acceptsEncoding reports whether the accept-encoding list includes the encoding, explicitly or with "*".
+func acceptsEncoding(accept string, encoding string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		name, params := part, ""
+
+		if i := strings.Index(part, ";"); i >= 0 {
+			name, params = part[:i], part[i+1:]
+		}
+
+		name = strings.TrimSpace(name)
+
+		if name != "*" && !strings.EqualFold(name, encoding) {
+			continue
+		}
+
+		// a zero quality means not acceptable.
+		if q := strings.TrimSpace(params); strings.HasPrefix(q, "q=") {
+			if quality, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64); err != nil || quality <= 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// decompress returns the body decoded according to its content encoding.
+func (c Compression) decompress(encoding string, body []byte) ([]byte, error) {
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+
+	comp, ok := compressors[encoding]
+
+	if !ok {
+		return nil, fmt.Errorf("Invalid content encoding, got: %s", encoding)
+	}
+
+	maxSize := c.MaxDecodedSize
+
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDecodedSize
+	}
+
+	return comp.decompress(body, maxSize)
+}
+
+func gzipCompress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(body []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	// reading one more byte tells a body of the maximum size from a larger one.
+	decoded, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decoded) > maxSize {
+		return nil, ErrDecodedSizeExceeded
+	}
+
+	return decoded, nil
+}
+
+// the zstd encoder and decoders are safe for concurrent use, they are created on first use.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdErr     error
+
+	// zstdDecoders holds a decoder per maximum decoded size.
+	zstdDecoders sync.Map
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+	})
+
+	return zstdErr
+}
+
+func zstdDecoderFor(maxSize int) (*zstd.Decoder, error) {
+	if d, ok := zstdDecoders.Load(maxSize); ok {
+		return d.(*zstd.Decoder), nil
+	}
+
+	d, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// another goroutine may have created it meanwhile.
+	if actual, loaded := zstdDecoders.LoadOrStore(maxSize, d); loaded {
+		d.Close()
+		return actual.(*zstd.Decoder), nil
+	}
+
+	return d, nil
+}
+
+func zstdCompress(body []byte) ([]byte, error) {
+	if err := initZstd(); err != nil {
+		return nil, err
+	}
+
+	return zstdEncoder.EncodeAll(body, nil), nil
+}
+
+func zstdDecompress(body []byte, maxSize int) ([]byte, error) {
+	d, err := zstdDecoderFor(maxSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := d.DecodeAll(body, nil)
+
+	// frames with a window larger than the maximum size are refused as well.
+	if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded {
+		return nil, ErrDecodedSizeExceeded
+	}
+
+	return decoded, err
+}
+
+func snappyCompress(body []byte) ([]byte, error) {
+	return snappy.Encode(nil, body), nil
+}
+
+func snappyDecompress(body []byte, maxSize int) ([]byte, error) {
+	// the decoded length is read from the header, before allocating it.
+	size, err := snappy.DecodedLen(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if size > maxSize {
+		return nil, ErrDecodedSizeExceeded
+	}
+
+	return snappy.Decode(nil, body)
+}
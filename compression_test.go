@@ -0,0 +1,90 @@
+package porthos
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"value": 10}`), 100)
+
+	for _, encoding := range []string{EncodingGzip, EncodingZstd, EncodingSnappy} {
+		compressed, contentEncoding, err := Compression{Encoding: encoding}.compress(body)
+
+		if assert.Nil(t, err, encoding) {
+			assert.Equal(t, encoding, contentEncoding)
+			assert.True(t, len(compressed) < len(body), encoding)
+
+			decompressed, err := Compression{}.decompress(contentEncoding, compressed)
+
+			assert.Nil(t, err, encoding)
+			assert.Equal(t, body, decompressed, encoding)
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 100)
+
+	compressed, encoding, err := Compression{Encoding: EncodingGzip, Threshold: 101}.compress(body)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "", encoding)
+	assert.Equal(t, body, compressed)
+
+	_, encoding, _ = Compression{Encoding: EncodingGzip, Threshold: 100}.compress(body)
+	assert.Equal(t, EncodingGzip, encoding)
+}
+
+func TestCompressionIncompressible(t *testing.T) {
+	compressed, encoding, err := Compression{Encoding: EncodingGzip}.compress([]byte("abc"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "", encoding)
+	assert.Equal(t, []byte("abc"), compressed)
+}
+
+func TestCompressionMaxDecodedSize(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 4096)
+
+	for _, encoding := range []string{EncodingGzip, EncodingZstd, EncodingSnappy} {
+		compressed, _, err := Compression{Encoding: encoding}.compress(body)
+
+		if assert.Nil(t, err, encoding) {
+			decompressed, err := Compression{MaxDecodedSize: 4096}.decompress(encoding, compressed)
+
+			assert.Nil(t, err, encoding)
+			assert.Equal(t, body, decompressed, encoding)
+
+			_, err = Compression{MaxDecodedSize: 4095}.decompress(encoding, compressed)
+			assert.Equal(t, ErrDecodedSizeExceeded, err, encoding)
+		}
+	}
+}
+
+func TestCompressionInvalidEncoding(t *testing.T) {
+	assert.Nil(t, Compression{}.validate())
+	assert.EqualError(t, Compression{Encoding: "br"}.validate(), "Invalid content encoding, got: br")
+
+	_, err := Compression{}.decompress("br", []byte("abc"))
+	assert.NotNil(t, err)
+
+	_, err = Compression{}.decompress(EncodingGzip, []byte("abc"))
+	assert.NotNil(t, err)
+
+	body, err := Compression{}.decompress("", []byte("abc"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), body)
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert.True(t, acceptsEncoding(builtinEncodings, EncodingZstd))
+	assert.True(t, acceptsEncoding("GZIP;q=0.5", EncodingGzip))
+	assert.True(t, acceptsEncoding("*", EncodingSnappy))
+
+	assert.False(t, acceptsEncoding("", EncodingGzip))
+	assert.False(t, acceptsEncoding("gzip", EncodingZstd))
+	assert.False(t, acceptsEncoding("gzip;q=0, *", EncodingGzip))
+}
@@ -0,0 +1,134 @@
+package porthos
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// confirmChannel is a channel in confirm mode that can be shared by many publishers.
+// Each publish is tracked by its delivery tag, so publishers wait for their own
+// confirmation concurrently instead of one publish at a time.
+type confirmChannel struct {
+	channel Channel
+
+	// publishLock serializes the publishes, the broker numbers the confirmations in publishing order.
+	// It is held while publishing, which may wait for the amqp dispatcher to deliver confirmations,
+	// so handleConfirms must never take it.
+	publishLock sync.Mutex
+	deliveryTag uint64
+
+	m       sync.Mutex
+	pending map[uint64]chan error
+	closed  bool
+}
+
+func newConfirmChannel(ch Channel) (*confirmChannel, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("Channel could not be put into confirm mode: %s", err)
+	}
+
+	c := &confirmChannel{
+		channel: ch,
+		pending: make(map[uint64]chan error),
+	}
+
+	go c.handleConfirms(ch.NotifyPublish(make(chan amqp.Confirmation, 64)))
+
+	return c, nil
+}
+
+// publish sends the message and waits for its broker confirmation or the context to be done.
+func (c *confirmChannel) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	confirmed, err := c.publishAsync(exchange, key, msg)
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-confirmed:
+		return err
+	case <-ctx.Done():
+		// the confirmation is dropped when it arrives.
+		return ctx.Err()
+	}
+}
+
+// publishAsync sends the message, the returned channel receives the outcome of its confirmation:
+// nil when acked, ErrNotAcked when nacked or amqp.ErrClosed if the channel closes first.
+func (c *confirmChannel) publishAsync(exchange, key string, msg amqp.Publishing) (<-chan error, error) {
+	c.publishLock.Lock()
+	defer c.publishLock.Unlock()
+
+	tag := c.deliveryTag + 1
+	confirmed := make(chan error, 1)
+
+	// registered before publishing, the confirmation may arrive before Publish returns.
+	c.m.Lock()
+
+	if c.closed {
+		c.m.Unlock()
+		return nil, amqp.ErrClosed
+	}
+
+	c.pending[tag] = confirmed
+	c.m.Unlock()
+
+	if err := c.channel.Publish(exchange, key, false, false, msg); err != nil {
+		c.m.Lock()
+		delete(c.pending, tag)
+		c.closed = true
+		c.m.Unlock()
+
+		return nil, err
+	}
+
+	c.deliveryTag = tag
+
+	return confirmed, nil
+}
+
+// handleConfirms resolves the pending publishes as their confirmations arrive.
+func (c *confirmChannel) handleConfirms(confirms <-chan amqp.Confirmation) {
+	for confirmation := range confirms {
+		c.m.Lock()
+		confirmed, ok := c.pending[confirmation.DeliveryTag]
+		delete(c.pending, confirmation.DeliveryTag)
+		c.m.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		if confirmation.Ack {
+			confirmed <- nil
+		} else {
+			confirmed <- ErrNotAcked
+		}
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.closed = true
+
+	for tag, confirmed := range c.pending {
+		confirmed <- amqp.ErrClosed
+		delete(c.pending, tag)
+	}
+}
+
+// isClosed reports whether the channel failed and can not be used anymore.
+func (c *confirmChannel) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.closed
+}
+
+func (c *confirmChannel) Close() error {
+	return c.channel.Close()
+}
@@ -0,0 +1,175 @@
+package porthos
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// manualConfirmChannel lets the test decide when and how each publish is confirmed.
+type manualConfirmChannel struct {
+	Channel
+	confirms chan amqp.Confirmation
+}
+
+func (ch *manualConfirmChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+func (ch *manualConfirmChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.confirms = confirm
+	return confirm
+}
+
+func (ch *manualConfirmChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return nil
+}
+
+func (ch *manualConfirmChannel) Close() error {
+	close(ch.confirms)
+	return nil
+}
+
+func receiveConfirm(t *testing.T, confirmed <-chan error) error {
+	select {
+	case err := <-confirmed:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("Publish not confirmed. Timedout.")
+	}
+
+	return nil
+}
+
+func TestConfirmChannelTracksDeliveryTags(t *testing.T) {
+	ch := &manualConfirmChannel{}
+	cc, _ := newConfirmChannel(ch)
+
+	first, _ := cc.publishAsync("", "test", amqp.Publishing{})
+	second, _ := cc.publishAsync("", "test", amqp.Publishing{})
+	third, _ := cc.publishAsync("", "test", amqp.Publishing{})
+
+	ch.confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	ch.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+
+	assert.Equal(t, ErrNotAcked, receiveConfirm(t, second))
+	assert.Nil(t, receiveConfirm(t, first))
+
+	cc.Close()
+
+	assert.Equal(t, amqp.ErrClosed, receiveConfirm(t, third))
+	assert.True(t, cc.isClosed())
+
+	_, err := cc.publishAsync("", "test", amqp.Publishing{})
+	assert.Equal(t, amqp.ErrClosed, err)
+}
+
+func TestConfirmChannelConcurrentPublishes(t *testing.T) {
+	b := newMemoryBroker(t, NewMemoryTransport())
+	defer b.Close()
+
+	ch, _ := b.openChannel()
+	cc, err := newConfirmChannel(ch)
+
+	if assert.Nil(t, err) {
+		var wg sync.WaitGroup
+
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				assert.Nil(t, cc.publish(context.Background(), "", "test", amqp.Publishing{}))
+			}()
+		}
+
+		wg.Wait()
+
+		cc.m.Lock()
+		assert.Empty(t, cc.pending)
+		cc.m.Unlock()
+	}
+}
+
+// dispatchingConfirmChannel delivers the confirmations like amqp does: from a dispatcher
+// which blocks the publishes while it waits to send them.
+type dispatchingConfirmChannel struct {
+	manualConfirmChannel
+	dispatching sync.Mutex
+	m           sync.Mutex
+	tag         uint64
+	queued      []amqp.Confirmation
+}
+
+func (ch *dispatchingConfirmChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.dispatching.Lock()
+	defer ch.dispatching.Unlock()
+
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	ch.tag++
+	ch.queued = append(ch.queued, amqp.Confirmation{DeliveryTag: ch.tag, Ack: true})
+
+	return nil
+}
+
+// dispatch sends the queued confirmations in batches, once there are more than the buffer holds.
+func (ch *dispatchingConfirmChannel) dispatch(batch int, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Millisecond):
+		}
+
+		ch.m.Lock()
+		queued := ch.queued
+
+		if len(queued) >= batch {
+			ch.queued = nil
+		}
+
+		ch.m.Unlock()
+
+		if len(queued) < batch {
+			continue
+		}
+
+		ch.dispatching.Lock()
+
+		for _, confirmation := range queued {
+			ch.confirms <- confirmation
+		}
+
+		ch.dispatching.Unlock()
+
+		batch = 1
+	}
+}
+
+func TestConfirmChannelManyConcurrentPublishes(t *testing.T) {
+	ch := &dispatchingConfirmChannel{}
+	cc, _ := newConfirmChannel(ch)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go ch.dispatch(100, done)
+
+	published := make(chan error, 500)
+
+	for i := 0; i < 500; i++ {
+		go func() {
+			published <- cc.publish(context.Background(), "", "test", amqp.Publishing{})
+		}()
+	}
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, receiveConfirm(t, published))
+	}
+}
@@ -2,10 +2,42 @@ package porthos
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
 	ErrTimedOut          = errors.New("timed out")
 	ErrNilPublishChannel = errors.New("No AMQP channel to publish the response to.")
 	ErrNotAcked          = errors.New("Request was no acked.")
+	ErrRequestExpired    = errors.New("Request expired before being processed.")
+	ErrServerClosed      = errors.New("Server closed.")
 )
+
+// PanicError is reported to the extensions when a method handler panics.
+type PanicError struct {
+	// Value passed to panic.
+	Value interface{}
+	// Stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Method handler panicked: %v", e.Value)
+}
+
+// MethodNotFoundError is returned when calling a method the service has not registered.
+// It wraps the *RPCError replied by the server.
+type MethodNotFoundError struct {
+	ServiceName string
+	MethodName  string
+	cause       error
+}
+
+func (e *MethodNotFoundError) Error() string {
+	return fmt.Sprintf("Method '%s' not found in service '%s'.", e.MethodName, e.ServiceName)
+}
+
+// Unwrap returns the *RPCError replied by the server.
+func (e *MethodNotFoundError) Unwrap() error {
+	return e.cause
+}
@@ -0,0 +1,189 @@
+package porthos
+
+import (
+	"sync"
+)
+
+// EventType identifies a change in the lifecycle of the broker connection.
+type EventType int
+
+const (
+	// EventConnected is delivered on Subscribe when the broker is connected.
+	EventConnected EventType = iota
+	// EventDisconnected is emitted when the connection is lost, Err holds the cause if known.
+	EventDisconnected
+	// EventReconnectAttempt is emitted after each failed reconnection attempt, with its number and error.
+	EventReconnectAttempt
+	// EventReconnected is emitted when the connection is reestablished, URL holds the node.
+	EventReconnected
+	// EventBlocked is emitted when the broker stops accepting publishes (flow control), Reason holds why.
+	EventBlocked
+	// EventUnblocked is emitted when the broker accepts publishes again.
+	EventUnblocked
+	// EventClosed is emitted when the broker stops for good, Err is ErrBrokerClosed or ErrRetriesExhausted.
+	// It is the last event of every subscription.
+	EventClosed
+)
+
+var eventTypeNames = map[EventType]string{
+	EventConnected:        "connected",
+	EventDisconnected:     "disconnected",
+	EventReconnectAttempt: "reconnect_attempt",
+	EventReconnected:      "reconnected",
+	EventBlocked:          "blocked",
+	EventUnblocked:        "unblocked",
+	EventClosed:           "closed",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// Event describes a change in the lifecycle of the broker connection.
+type Event struct {
+	Type EventType
+	// URL of the node the broker is, or was, connected to.
+	URL string
+	// Err is the cause of a disconnection, a failed attempt or closing.
+	Err error
+	// Attempt is the number of the failed reconnection attempt, starting at 1.
+	Attempt int
+	// Reason given by the broker when blocking the connection.
+	Reason string
+}
+
+// Subscription receives the lifecycle events of a broker, see Broker.Subscribe.
+// Events are queued, so a slow subscriber never holds the broker back.
+type Subscription struct {
+	broker  *Broker
+	events  chan Event
+	stop    chan struct{}
+	m       sync.Mutex
+	cond    *sync.Cond
+	queue   []Event
+	closed  bool
+	stopped bool
+}
+
+// Subscribe starts receiving the broker lifecycle events, from now on.
+// The events channel is closed after EventClosed or when unsubscribing.
+func (b *Broker) Subscribe() *Subscription {
+	s := &Subscription{
+		broker: b,
+		events: make(chan Event),
+		stop:   make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.m)
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.closed {
+		s.push(Event{Type: EventClosed, URL: b.urls[b.current], Err: b.err})
+		s.close()
+	} else {
+		if b.connected {
+			s.push(Event{Type: EventConnected, URL: b.urls[b.current]})
+		}
+
+		b.subscriptionsLock.Lock()
+		b.subscriptions[s] = true
+		b.subscriptionsLock.Unlock()
+	}
+
+	go s.run()
+
+	return s
+}
+
+// Events returns the channel the events are delivered to.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Unsubscribe stops receiving events, the pending ones are discarded.
+func (s *Subscription) Unsubscribe() {
+	s.broker.subscriptionsLock.Lock()
+	delete(s.broker.subscriptions, s)
+	s.broker.subscriptionsLock.Unlock()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.stopped {
+		s.stopped = true
+		s.closed = true
+		close(s.stop)
+		s.cond.Signal()
+	}
+}
+
+// emit delivers the event to all subscriptions. It must be called holding the broker lock,
+// or the blocked lock for the flow control events.
+func (b *Broker) emit(e Event) {
+	b.subscriptionsLock.Lock()
+	defer b.subscriptionsLock.Unlock()
+
+	for s := range b.subscriptions {
+		s.push(e)
+
+		if e.Type == EventClosed {
+			s.close()
+		}
+	}
+
+	if e.Type == EventClosed {
+		b.subscriptions = nil
+	}
+}
+
+func (s *Subscription) push(e Event) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.closed {
+		s.queue = append(s.queue, e)
+		s.cond.Signal()
+	}
+}
+
+// close stops queueing events, the queued ones are still delivered.
+func (s *Subscription) close() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.closed = true
+	s.cond.Signal()
+}
+
+func (s *Subscription) run() {
+	defer close(s.events)
+
+	for {
+		s.m.Lock()
+
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+
+		if len(s.queue) == 0 {
+			s.m.Unlock()
+			return
+		}
+
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+
+		s.m.Unlock()
+
+		select {
+		case s.events <- e:
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package porthos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func receiveEvent(t *testing.T, sub *Subscription) Event {
+	select {
+	case e, ok := <-sub.Events():
+		if !ok {
+			t.Fatal("Events channel closed.")
+		}
+
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("No event received. Timedout.")
+	}
+
+	return Event{}
+}
+
+func TestBrokerEvents(t *testing.T) {
+	transport := NewMemoryTransport()
+	b := newMemoryBroker(t, transport)
+
+	sub := b.Subscribe()
+
+	e := receiveEvent(t, sub)
+	assert.Equal(t, EventConnected, e.Type)
+	assert.Equal(t, "memory://", e.URL)
+
+	transport.Block("low on memory")
+
+	e = receiveEvent(t, sub)
+	assert.Equal(t, EventBlocked, e.Type)
+	assert.Equal(t, "low on memory", e.Reason)
+
+	transport.Unblock()
+	assert.Equal(t, EventUnblocked, receiveEvent(t, sub).Type)
+
+	transport.SetDialError(ErrBrokerNotConnected)
+	transport.Disconnect()
+
+	e = receiveEvent(t, sub)
+	assert.Equal(t, EventDisconnected, e.Type)
+
+	if err, ok := e.Err.(*amqp.Error); assert.True(t, ok) {
+		assert.Equal(t, amqp.ConnectionForced, err.Code)
+	}
+
+	e = receiveEvent(t, sub)
+	assert.Equal(t, EventReconnectAttempt, e.Type)
+	assert.Equal(t, 1, e.Attempt)
+	assert.Equal(t, ErrBrokerNotConnected, e.Err)
+
+	transport.SetDialError(nil)
+
+	for e.Type == EventReconnectAttempt {
+		e = receiveEvent(t, sub)
+	}
+
+	assert.Equal(t, EventReconnected, e.Type)
+
+	b.Close()
+
+	e = receiveEvent(t, sub)
+	assert.Equal(t, EventClosed, e.Type)
+	assert.Equal(t, ErrBrokerClosed, e.Err)
+
+	_, ok := <-sub.Events()
+	assert.False(t, ok, "Events channel must be closed after EventClosed.")
+
+	sub = b.Subscribe()
+	assert.Equal(t, EventClosed, receiveEvent(t, sub).Type)
+}
+
+func TestBrokerUnsubscribe(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	b := newMemoryBroker(t, transport)
+	defer b.Close()
+
+	sub := b.Subscribe()
+	sub.Unsubscribe()
+
+	// events are not read, but the broker must not be held back.
+	rs := b.NotifyReestablish()
+
+	for i := 0; i < 2; i++ {
+		transport.Disconnect()
+
+		select {
+		case <-rs:
+		case <-time.After(time.Second):
+			t.Fatal("Connection not reestablished. Timedout.")
+		}
+	}
+
+	for range sub.Events() {
+	}
+}
+
+func TestNotifyReestablishDoesNotBlock(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	b := newMemoryBroker(t, transport)
+	defer b.Close()
+
+	b.NotifyReestablish()
+	sub := b.Subscribe()
+	receiveEvent(t, sub)
+
+	for i := 0; i < 2; i++ {
+		transport.Disconnect()
+
+		for e := receiveEvent(t, sub); e.Type != EventReconnected; e = receiveEvent(t, sub) {
+		}
+	}
+}
+
+func TestNotifyReestablishDuringReconnection(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	b := newMemoryBroker(t, transport)
+	defer b.Close()
+
+	sub := b.Subscribe()
+	receiveEvent(t, sub)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			b.NotifyReestablish()
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		transport.Disconnect()
+
+		for e := receiveEvent(t, sub); e.Type != EventReconnected; e = receiveEvent(t, sub) {
+		}
+	}
+
+	<-done
+}
+
+func TestStopNotifyReestablish(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	b := newMemoryBroker(t, transport)
+	defer b.Close()
+
+	sub := b.Subscribe()
+	receiveEvent(t, sub)
+
+	stopped := b.NotifyReestablish()
+	notified := b.NotifyReestablish()
+
+	b.StopNotifyReestablish(stopped)
+
+	transport.Disconnect()
+
+	for e := receiveEvent(t, sub); e.Type != EventReconnected; e = receiveEvent(t, sub) {
+	}
+
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the reestablish notification")
+	}
+
+	select {
+	case <-stopped:
+		t.Fatal("Expected no notification after StopNotifyReestablish")
+	default:
+	}
+
+	b.m.Lock()
+	assert.Len(t, b.reestablishs, 1)
+	b.m.Unlock()
+}
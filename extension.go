@@ -7,3 +7,9 @@ type Extension interface {
 	IncomingRequest(req Request)
 	OutgoingResponse(req Request, res Response, resTime time.Duration, statusCode int32)
 }
+
+// FailureExtension can be implemented by extensions that want to be notified
+// about requests that could not be handled, such as expired ones.
+type FailureExtension interface {
+	RequestFailed(req Request, err error)
+}
@@ -1,11 +1,5 @@
 package porthos
 
-import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-)
-
 // Form represents a request form where data are retrieved through indexes.
 type Form interface {
 	// GetArg returns an argument giving the index.
@@ -17,16 +11,10 @@ type form struct {
 }
 
 // NewForm creates a new form to retrieve values from its index.
+// The body is decoded as an array with the codec of the content type.
 func NewForm(contentType string, body []byte) (Form, error) {
-	if contentType != "application/json" {
-		return nil, fmt.Errorf("Invalid content type, got: %s", contentType)
-	}
-
-	decoder := json.NewDecoder(bytes.NewReader(body))
-	decoder.UseNumber()
-
 	args := new([]interface{})
-	err := decoder.Decode(args)
+	err := Unmarshal(contentType, body, args)
 
 	if err != nil {
 		return nil, err
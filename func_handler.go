@@ -0,0 +1,133 @@
+package porthos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Validator is implemented by the inputs of the function handlers that validate themselves.
+// A non nil error is replied as an invalid argument error, unless it is an *RPCError.
+type Validator interface {
+	Validate() error
+}
+
+// NewFuncHandler creates a MethodHandler from a function like:
+//
+//     func(ctx context.Context, in *In) (*Out, error)
+//
+// The request body is decoded into a new In (validated if it implements Validator), the
+// returned Out is replied with Response.Encode and StatusOK (or StatusNoContent if nil) and the returned
+// error is replied with Response.Error. The Spec is derived from the In and Out structs and
+// describes their JSON shape only, the other registered codecs are accepted but not listed.
+func NewFuncHandler(fn interface{}) (MethodHandler, Spec, error) {
+	fnValue := reflect.ValueOf(fn)
+
+	if !fnValue.IsValid() || fnValue.Kind() != reflect.Func || fnValue.IsNil() {
+		return nil, Spec{}, fmt.Errorf("Invalid handler function %T, expected func(context.Context, *In) (Out, error).", fn)
+	}
+
+	fnType := fnValue.Type()
+
+	if fnType.NumIn() != 2 || fnType.In(0) != contextType || fnType.In(1).Kind() != reflect.Ptr ||
+		fnType.NumOut() != 2 || fnType.Out(1) != errorType {
+		return nil, Spec{}, fmt.Errorf("Invalid handler function %s, expected func(context.Context, *In) (Out, error).", fnType)
+	}
+
+	inType := fnType.In(1).Elem()
+	outType := fnType.Out(0)
+
+	handler := func(req Request, res Response) {
+		in := reflect.New(inType)
+
+		if len(req.GetBody()) > 0 {
+			if err := req.Bind(in.Interface()); err != nil {
+				res.Error(NewInvalidArgumentError(fmt.Sprintf("Invalid request body: %s", err), nil))
+				return
+			}
+		}
+
+		if v, ok := in.Interface().(Validator); ok {
+			if err := v.Validate(); err != nil {
+				res.Error(validationError(err))
+				return
+			}
+		}
+
+		results := fnValue.Call([]reflect.Value{reflect.ValueOf(req.Context()), in})
+
+		if err, _ := results[1].Interface().(error); err != nil {
+			res.Error(handlerError(err))
+			return
+		}
+
+		out := results[0]
+
+		if isNil(out) {
+			res.Empty(StatusNoContent)
+			return
+		}
+
+		res.Encode(StatusOK, out.Interface())
+	}
+
+	spec := Spec{
+		Request:  contentSpecFromType(inType),
+		Response: contentSpecFromType(outType),
+	}
+
+	return handler, spec, nil
+}
+
+// validationError returns the error to reply when the input is not valid.
+func validationError(err error) error {
+	var rpcErr *RPCError
+
+	if errors.As(err, &rpcErr) {
+		return err
+	}
+
+	return NewInvalidArgumentError(err.Error(), nil)
+}
+
+// handlerError returns the error to reply when the handler function fails.
+func handlerError(err error) error {
+	var rpcErr *RPCError
+
+	if !errors.As(err, &rpcErr) && errors.Is(err, context.DeadlineExceeded) {
+		rpcErr = NewRPCError(StatusGatewayTimeout, ErrorCodeDeadlineExceeded, err.Error())
+		rpcErr.Retryable = true
+
+		return rpcErr
+	}
+
+	return err
+}
+
+// contentSpecFromType describes the JSON encoding of the type, whatever the codec in use.
+func contentSpecFromType(t reflect.Type) ContentSpec {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return ContentSpec{ContentType: ContentTypeJSON}
+	}
+
+	return ContentSpec{ContentType: ContentTypeJSON, Body: bodySpecFromStructType(t)}
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return v.IsNil()
+	}
+
+	return false
+}
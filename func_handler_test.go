@@ -0,0 +1,107 @@
+package porthos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sumInput struct {
+	A int `json:"a" description:"First operand"`
+	B int `json:"b"`
+}
+
+func (in *sumInput) Validate() error {
+	if in.A < 0 || in.B < 0 {
+		return errors.New("Operands must be positive.")
+	}
+
+	return nil
+}
+
+type sumOutput struct {
+	Sum int `json:"sum"`
+}
+
+func sum(ctx context.Context, in *sumInput) (*sumOutput, error) {
+	if in.A == 42 {
+		return nil, fmt.Errorf("sum: %w", context.DeadlineExceeded)
+	}
+
+	if in.A == 0 && in.B == 0 {
+		return nil, nil
+	}
+
+	return &sumOutput{Sum: in.A + in.B}, nil
+}
+
+func callFuncHandler(t *testing.T, handler MethodHandler, body string) Response {
+	req := &request{contentType: "application/json", body: []byte(body)}
+	res := newResponse()
+
+	handler(req, res)
+
+	return res
+}
+
+func decodeResponseError(t *testing.T, res Response) *RPCError {
+	rpcErr := &RPCError{}
+
+	if err := json.Unmarshal(res.GetBody(), rpcErr); err != nil {
+		t.Fatal(err)
+	}
+
+	return rpcErr
+}
+
+func TestFuncHandler(t *testing.T) {
+	handler, spec, err := NewFuncHandler(sum)
+
+	if assert.Nil(t, err) {
+		res := callFuncHandler(t, handler, `{"a": 1, "b": 2}`)
+		assert.Equal(t, StatusOK, res.GetStatusCode())
+		assert.JSONEq(t, `{"sum": 3}`, string(res.GetBody()))
+
+		res = callFuncHandler(t, handler, ``)
+		assert.Equal(t, StatusNoContent, res.GetStatusCode())
+
+		res = callFuncHandler(t, handler, `{"a": "one"}`)
+		assert.Equal(t, StatusBadRequest, res.GetStatusCode())
+		assert.Equal(t, ErrorCodeInvalidArgument, decodeResponseError(t, res).Code)
+
+		res = callFuncHandler(t, handler, `{"a": -1}`)
+		assert.Equal(t, StatusBadRequest, res.GetStatusCode())
+		assert.Equal(t, "Operands must be positive.", decodeResponseError(t, res).Message)
+
+		res = callFuncHandler(t, handler, `{"a": 42}`)
+		assert.Equal(t, StatusGatewayTimeout, res.GetStatusCode())
+		assert.True(t, decodeResponseError(t, res).Retryable)
+
+		assert.Equal(t, "application/json", spec.Request.ContentType)
+		assert.Equal(t, "First operand", spec.Request.Body.(BodySpecMap)["a"].Description)
+		assert.Equal(t, "int", spec.Response.Body.(BodySpecMap)["sum"].Type)
+	}
+}
+
+func TestFuncHandlerInvalidSignatures(t *testing.T) {
+	var nilFunc func(ctx context.Context, in *sumInput) (*sumOutput, error)
+
+	invalid := []interface{}{
+		nil,
+		nilFunc,
+		"not a function",
+		func(in *sumInput) (*sumOutput, error) { return nil, nil },
+		func(ctx context.Context, in sumInput) (*sumOutput, error) { return nil, nil },
+		func(ctx context.Context, in *sumInput) *sumOutput { return nil },
+		func(ctx context.Context, in *sumInput) (*sumOutput, bool) { return nil, false },
+	}
+
+	for _, fn := range invalid {
+		_, _, err := NewFuncHandler(fn)
+		assert.NotNil(t, err, "%T must be rejected.", fn)
+	}
+}
@@ -1,9 +1,13 @@
 module github.com/porthos-rpc/porthos-go
 
-go 1.12
+go 1.13
 
 require (
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/klauspost/compress v1.13.6
 	github.com/pkg/errors v0.8.1
 	github.com/streadway/amqp v0.0.0-20190404075320-75d898a42a94
-	github.com/stretchr/testify v1.3.0
+	github.com/stretchr/testify v1.6.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	google.golang.org/protobuf v1.28.1
 )
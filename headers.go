@@ -14,6 +14,10 @@ func NewHeaders() *Headers {
 
 // NewHeadersFromMap creates a new Headers from a map.
 func NewHeadersFromMap(m map[string]interface{}) *Headers {
+	if m == nil {
+		m = make(map[string]interface{})
+	}
+
 	return &Headers{
 		m,
 	}
@@ -34,6 +38,16 @@ func (h *Headers) Delete(key string) {
 	delete(h.headers, key)
 }
 
+func (h *Headers) clone() *Headers {
+	c := NewHeaders()
+
+	for k, v := range h.headers {
+		c.headers[k] = v
+	}
+
+	return c
+}
+
 func (h *Headers) asMap() map[string]interface{} {
 	return h.headers
 }
@@ -1,10 +1,17 @@
 package porthos
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -12,6 +19,34 @@ func getAmqpUrl() string {
 	return os.Getenv("AMQP_URL")
 }
 
+// newTestBroker connects to AMQP_URL when it is set, otherwise to a fresh in-memory broker.
+func newTestBroker(t *testing.T) *Broker {
+	if getAmqpUrl() == "" {
+		return newMemoryBroker(t, NewMemoryTransport())
+	}
+
+	b, err := NewBroker(getAmqpUrl())
+
+	if err != nil {
+		t.Fatalf("Failed to connect to the broker: %s", err)
+	}
+
+	return b
+}
+
+func newMemoryBroker(t *testing.T, transport *MemoryTransport) *Broker {
+	b, err := NewBrokerConfig("memory://", Config{
+		ReconnectInterval: 10 * time.Millisecond,
+		Transport:         transport,
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to create the memory broker: %s", err)
+	}
+
+	return b
+}
+
 type testPorthosResponse struct {
 	Original int `json:"original_value"`
 	Sum      int `json:"value_plus_one"`
@@ -25,51 +60,1147 @@ func TestClientServerSync(t *testing.T) {
 	serverName := "TestClientServer"
 	methodName := "method"
 
-	b, err := NewBroker(getAmqpUrl())
+	b := newTestBroker(t)
+	defer b.Close()
 
-	if assert.Nil(t, err) {
-		defer b.Close()
+	server, err := NewServer(b, serverName, Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+		requestPayload := testPorthosRequest{Value: 1}
 
-		server, err := NewServer(b, serverName, Options{AutoAck: false})
-		if assert.Nil(t, err, "Failed to create server.") {
-			defer server.Close()
-			requestPayload := testPorthosRequest{Value: 1}
+		server.Register(methodName, func(req Request, res Response) {
+			payload := &testPorthosRequest{}
+
+			assert.Nil(t, req.Bind(payload))
+
+			res.JSON(StatusOK, testPorthosResponse{payload.Value, payload.Value + 1})
+		})
+
+		server.Register("dummyMethod", func(req Request, res Response) {
+			payload := &testPorthosRequest{}
+
+			assert.Nil(t, req.Bind(payload))
+
+			res.JSON(StatusOK, testPorthosResponse{payload.Value, payload.Value + 2})
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, serverName, 1*time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			ret, err := client.Call(methodName).WithStruct(requestPayload).Sync()
+
+			if assert.Nil(t, err, "Failed to call remote method.") {
+				responsePayload := &testPorthosResponse{}
+
+				assert.Equal(t, StatusOK, ret.StatusCode)
+				if assert.Nil(t, ret.UnmarshalJSONTo(responsePayload)) {
+					assert.Equal(t, requestPayload.Value, responsePayload.Original)
+					assert.Equal(t, requestPayload.Value+1, responsePayload.Sum)
+				}
+			}
+		}
+	}
+}
+
+func TestClientServerTimeout(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerTimeout", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("slow", func(req Request, res Response) {
+			time.Sleep(200 * time.Millisecond)
+			res.Empty(StatusOK)
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestClientServerTimeout", 50*time.Millisecond)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			_, err := client.Call("slow").Sync()
+
+			assert.Equal(t, ErrTimedOut, err)
+		}
+	}
+}
 
-			server.Register(methodName, func(req Request, res Response) {
-				payload := &testPorthosRequest{}
+func TestClientServerReconnection(t *testing.T) {
+	transport := NewMemoryTransport()
 
-				assert.Nil(t, req.Bind(payload))
+	b := newMemoryBroker(t, transport)
+	defer b.Close()
 
-				res.JSON(StatusOK, testPorthosResponse{payload.Value, payload.Value + 1})
+	server, err := NewServer(b, "TestClientServerReconnection", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("method", func(req Request, res Response) {
+			res.Empty(StatusOK)
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestClientServerReconnection", 100*time.Millisecond)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			_, err := client.Call("method").Sync()
+			assert.Nil(t, err)
+
+			transport.Disconnect()
+
+			deadline := time.Now().Add(5 * time.Second)
+
+			for {
+				_, err = client.Call("method").Sync()
+
+				if err == nil || time.Now().After(deadline) {
+					break
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			assert.Nil(t, err, "Calls must succeed after the connection is reestablished.")
+		}
+	}
+}
+
+func TestClientServerContext(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerContext", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("slow", func(req Request, res Response) {
+			time.Sleep(200 * time.Millisecond)
+			res.Empty(StatusOK)
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestClientServerContext", 10*time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			_, err := client.Call("slow").SyncContext(ctx)
+			assert.Equal(t, ErrTimedOut, err)
+
+			ctx, cancelAsync := context.WithCancel(context.Background())
+			defer cancelAsync()
+
+			slot, err := client.Call("slow").AsyncContext(ctx)
+
+			if assert.Nil(t, err) {
+				responses := slot.ResponseChannel()
+				cancelAsync()
+
+				select {
+				case _, ok := <-responses:
+					assert.False(t, ok, "Slot must be disposed when the context is canceled.")
+				case <-time.After(time.Second):
+					t.Error("Slot was not disposed.")
+				}
+			}
+
+			res, err := client.Call("slow").SyncContext(context.Background())
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, StatusOK, res.StatusCode)
+			}
+		}
+	}
+}
+
+type failureRecorder struct {
+	AccessLogExtension
+	failures chan error
+}
+
+func (f *failureRecorder) RequestFailed(req Request, err error) {
+	f.failures <- err
+}
+
+func TestServerRequestDeadline(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestServerRequestDeadline", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		deadlines := make(chan time.Time, 1)
+
+		server.Register("method", func(req Request, res Response) {
+			deadline, _ := req.Context().Deadline()
+			deadlines <- deadline
+
+			res.Empty(StatusOK)
+		})
+
+		recorder := &failureRecorder{failures: make(chan error, 1)}
+		server.AddExtension(recorder)
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestServerRequestDeadline", time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			started := time.Now()
+
+			_, err := client.Call("method").Sync()
+
+			if assert.Nil(t, err) {
+				deadline := <-deadlines
+
+				assert.WithinDuration(t, started.Add(time.Second), deadline, 100*time.Millisecond)
+			}
+
+			// a request its caller gave up on a minute ago.
+			ch, _ := b.openChannel()
+			defer ch.Close()
+
+			publishedAt := time.Now().Add(-time.Minute)
+
+			ch.Publish("", "TestServerRequestDeadline", false, false, amqp.Publishing{
+				Headers: amqp.Table{
+					"X-Method":       "method",
+					"X-Published-At": unixMilliseconds(publishedAt),
+				},
+				Timestamp:  publishedAt,
+				Expiration: "1000",
 			})
 
-			server.Register("dummyMethod", func(req Request, res Response) {
-				payload := &testPorthosRequest{}
+			select {
+			case err := <-recorder.failures:
+				assert.Equal(t, ErrRequestExpired, err)
+			case <-deadlines:
+				t.Error("Expired request must not be handled.")
+			case <-time.After(time.Second):
+				t.Error("Expired request was not reported.")
+			}
+		}
+	}
+}
+
+func TestServerConcurrency(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestServerConcurrency", Options{AutoAck: false, Concurrency: 2})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		var m sync.Mutex
+		running, maxRunning := 0, 0
+
+		server.Register("method", func(req Request, res Response) {
+			m.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			m.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			m.Lock()
+			running--
+			m.Unlock()
+
+			res.Empty(StatusOK)
+		})
 
-				assert.Nil(t, req.Bind(payload))
+		go server.ListenAndServe()
 
-				res.JSON(StatusOK, testPorthosResponse{payload.Value, payload.Value + 2})
+		client, err := NewClient(b, "TestServerConcurrency", time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			var wg sync.WaitGroup
+
+			for i := 0; i < 6; i++ {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					_, err := client.Call("method").Sync()
+					assert.Nil(t, err)
+				}()
+			}
+
+			wg.Wait()
+
+			assert.Equal(t, 2, maxRunning)
+		}
+	}
+}
+
+func TestServerPanicRecovery(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestServerPanicRecovery", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("panic", func(req Request, res Response) {
+			res.JSON(StatusOK, nil)
+		})
+
+		server.Register("method", func(req Request, res Response) {
+			res.Empty(StatusOK)
+		})
+
+		recorder := &failureRecorder{failures: make(chan error, 1)}
+		server.AddExtension(recorder)
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestServerPanicRecovery", time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			res, err := client.Call("panic").Sync()
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, StatusInternalServerError, res.StatusCode)
+
+				body, err := res.UnmarshalJSON()
+
+				if assert.Nil(t, err) {
+					assert.Equal(t, "internal_error", body["code"])
+				}
+			}
+
+			if failure, ok := (<-recorder.failures).(*PanicError); assert.True(t, ok) {
+				assert.Equal(t, "Response body is empty", failure.Value)
+			}
+
+			res, err = client.Call("method").Sync()
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, StatusOK, res.StatusCode)
+			}
+		}
+	}
+}
+
+// settleRecorder is an acknowledger recording how the delivery was settled.
+type settleRecorder struct {
+	m       sync.Mutex
+	settled []string
+}
+
+func (r *settleRecorder) record(how string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.settled = append(r.settled, how)
+	return nil
+}
+
+func (r *settleRecorder) Ack(tag uint64, multiple bool) error {
+	return r.record("ack")
+}
+
+func (r *settleRecorder) Nack(tag uint64, multiple bool, requeue bool) error {
+	return r.record("nack")
+}
+
+func (r *settleRecorder) Reject(tag uint64, requeue bool) error {
+	return r.record("reject")
+}
+
+func TestServerReplyFailureSettles(t *testing.T) {
+	b := newMemoryBroker(t, NewMemoryTransport())
+
+	srv, err := NewServer(b, "TestServerReplyFailureSettles", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		srv.Register("method", func(req Request, res Response) {
+			res.Empty(StatusOK)
+		})
+
+		// the reply can't be published anymore.
+		b.Close()
+
+		for _, method := range []string{"method", "missing"} {
+			recorder := &settleRecorder{}
+
+			srv.(*server).handle(amqp.Delivery{
+				Acknowledger:  recorder,
+				Headers:       amqp.Table{"X-Method": method},
+				ReplyTo:       "reply",
+				CorrelationId: "correlationId",
 			})
 
-			go server.ListenAndServe()
+			assert.Equal(t, []string{"reject"}, recorder.settled, method)
+		}
+	}
+}
+
+func TestClientServerMethodNotFound(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerMethodNotFound", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestClientServerMethodNotFound", 5*time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			started := time.Now()
+
+			_, err := client.Call("unknown").Sync()
+
+			var notFound *MethodNotFoundError
+
+			if assert.True(t, errors.As(err, &notFound)) {
+				assert.Equal(t, "TestClientServerMethodNotFound", notFound.ServiceName)
+				assert.Equal(t, "unknown", notFound.MethodName)
+			}
+
+			var rpcErr *RPCError
+
+			if assert.True(t, errors.As(err, &rpcErr), "The error must wrap the server reply.") {
+				assert.Equal(t, ErrorCodeMethodNotFound, rpcErr.Code)
+				assert.Equal(t, StatusNotFound, rpcErr.StatusCode)
+			}
+
+			assert.True(t, time.Since(started) < time.Second, "Call must fail fast.")
+
+			slot, err := client.Call("unknown").Async()
+
+			if assert.Nil(t, err) {
+				defer slot.Dispose()
+
+				res := <-slot.ResponseChannel()
+				assert.Equal(t, StatusNotFound, res.StatusCode)
+			}
+		}
+	}
+}
+
+func TestClientServerHeaders(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerHeaders", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("tenant", func(req Request, res Response) {
+			res.Raw(StatusOK, "text/plain", []byte(req.GetHeaders().Get("X-Tenant").(string)))
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestClientServerHeaders", time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			res, err := client.Call("tenant").WithHeader("X-Tenant", "acme").Sync()
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, "acme", string(res.Content))
+			}
+		}
+	}
+}
+
+func TestClientServerDirectReplyTo(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerDirectReplyTo", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("echo", func(req Request, res Response) {
+			res.Raw(StatusOK, "text/plain", req.GetBody())
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClientWithOptions(b, "TestClientServerDirectReplyTo", ClientOptions{
+			DefaultTTL:    time.Second,
+			DirectReplyTo: true,
+		})
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			assert.Empty(t, client.responseQueueName, "No response queue must be declared.")
+
+			for _, body := range []string{"first", "second"} {
+				res, err := client.Call("echo").WithBody([]byte(body)).Sync()
+
+				if assert.Nil(t, err) {
+					assert.Equal(t, body, string(res.Content))
+				}
+			}
+		}
+	}
+}
+
+func TestClientCloseReleasesConsumer(t *testing.T) {
+	b := newMemoryBroker(t, NewMemoryTransport())
+	defer b.Close()
+
+	for i := 0; i < 3; i++ {
+		client, err := NewClientWithOptions(b, "TestClientCloseReleasesConsumer", ClientOptions{
+			DefaultTTL:    time.Second,
+			DirectReplyTo: true,
+		})
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			ch := client.channel.(*memoryChannel)
+
+			client.Close()
+
+			assert.Nil(t, client.getReplyChannel())
+			assert.Equal(t, amqp.ErrClosed, ch.Close(), "The consumer channel must be closed.")
+			_, err = client.Call("echo").Async()
+			assert.Equal(t, ErrBrokerNotConnected, err)
+		}
+	}
+
+	// the consumer goroutines return, removing their reestablish listeners.
+	assert.Eventually(t, func() bool {
+		b.m.Lock()
+		defer b.m.Unlock()
+
+		return len(b.reestablishs) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerShutdownDrains(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestServerShutdownDrains", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		started := make(chan bool, 1)
 
-			client, err := NewClient(b, serverName, 1*time.Second)
+		server.Register("slow", func(req Request, res Response) {
+			started <- true
+			time.Sleep(50 * time.Millisecond)
+			res.Raw(StatusOK, "text/plain", []byte("done"))
+		})
 
-			if assert.Nil(t, err, "Failed to create client.") {
-				defer client.Close()
+		go server.ListenAndServe()
 
-				ret, err := client.Call(methodName).WithStruct(requestPayload).Sync()
+		client, err := NewClient(b, "TestServerShutdownDrains", time.Second)
 
-				if assert.Nil(t, err, "Failed to call remote method.") {
-					responsePayload := &testPorthosResponse{}
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
 
-					assert.Equal(t, StatusOK, ret.StatusCode)
-					if assert.Nil(t, ret.UnmarshalJSONTo(responsePayload)) {
-						assert.Equal(t, requestPayload.Value, responsePayload.Original)
-						assert.Equal(t, requestPayload.Value+1, responsePayload.Sum)
+			slot, err := client.Call("slow").Async()
+			assert.Nil(t, err)
+
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			assert.Nil(t, server.Shutdown(ctx))
+
+			select {
+			case res := <-slot.ResponseChannel():
+				assert.Equal(t, "done", string(res.Content))
+			case <-time.After(time.Second):
+				t.Error("The response must be sent before the shutdown completes.")
+			}
+
+			<-server.Done()
+			assert.Equal(t, ErrServerClosed, server.Err())
+		}
+	}
+}
+
+func TestServerClosedBeforeServing(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	for _, stop := range []func(s Server){
+		func(s Server) { s.Close() },
+		func(s Server) { assert.Nil(t, s.Shutdown(context.Background())) },
+	} {
+		server, err := NewServer(b, "TestServerClosedBeforeServing", Options{AutoAck: false})
+
+		if assert.Nil(t, err, "Failed to create server.") {
+			closed := server.NotifyClose()
+
+			stop(server)
+			server.ListenAndServe()
+
+			select {
+			case <-server.Done():
+			case <-time.After(time.Second):
+				t.Fatal("The server must be done once closed.")
+			}
+
+			assert.Equal(t, ErrServerClosed, server.Err())
+			assert.True(t, <-closed)
+		}
+	}
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestServerShutdownDeadline", Options{AutoAck: false, Concurrency: 1, PrefetchCount: 2})
+	if assert.Nil(t, err, "Failed to create server.") {
+		started := make(chan bool, 2)
+		release := make(chan bool)
+		defer close(release)
+
+		server.Register("blocked", func(req Request, res Response) {
+			started <- true
+			<-release
+			res.Empty(StatusOK)
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestServerShutdownDeadline", time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			assert.Nil(t, client.Call("blocked").Void())
+			assert.Nil(t, client.Call("blocked").Void())
+
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+
+			// both requests are requeued for another server.
+			next, err := NewServer(b, "TestServerShutdownDeadline", Options{AutoAck: false})
+
+			if assert.Nil(t, err, "Failed to create server.") {
+				defer next.Close()
+
+				redelivered := make(chan bool, 2)
+
+				next.Register("blocked", func(req Request, res Response) {
+					redelivered <- true
+				})
+
+				go next.ListenAndServe()
+
+				for i := 0; i < 2; i++ {
+					select {
+					case <-redelivered:
+					case <-time.After(time.Second):
+						t.Fatal("Request not requeued. Timedout.")
 					}
 				}
 			}
 		}
 	}
 }
+
+func TestClientServerRPCError(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerRPCError", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("validate", func(req Request, res Response) {
+			rpcErr := NewInvalidArgumentError("Value must be positive.", map[string]interface{}{"field": "value"})
+			rpcErr.Retryable = true
+
+			res.Error(fmt.Errorf("validating: %w", rpcErr))
+		})
+
+		server.Register("fail", func(req Request, res Response) {
+			res.Error(errors.New("database unavailable"))
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestClientServerRPCError", time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			res, err := client.Call("validate").Sync()
+
+			if assert.Nil(t, err) {
+				var rpcErr *RPCError
+
+				if assert.True(t, errors.As(res.Err(), &rpcErr)) {
+					assert.Equal(t, StatusBadRequest, rpcErr.StatusCode)
+					assert.Equal(t, ErrorCodeInvalidArgument, rpcErr.Code)
+					assert.Equal(t, "Value must be positive.", rpcErr.Message)
+					assert.Equal(t, "value", rpcErr.Details["field"])
+					assert.True(t, rpcErr.Retryable)
+				}
+			}
+
+			res, err = client.Call("fail").Sync()
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, &RPCError{
+					StatusCode: StatusInternalServerError,
+					Code:       ErrorCodeInternal,
+					Message:    "Internal server error.",
+				}, res.Err())
+			}
+		}
+	}
+}
+
+func TestClientServerRegisterFunc(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerRegisterFunc", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		assert.Nil(t, server.RegisterFunc("sum", sum))
+		assert.NotNil(t, server.RegisterFunc("invalid", func() {}))
+		assert.Contains(t, server.GetSpecs(), "sum")
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestClientServerRegisterFunc", time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			res, err := client.Call("sum").WithStruct(sumInput{A: 1, B: 2}).Sync()
+
+			if assert.Nil(t, err) {
+				out := &sumOutput{}
+
+				assert.Nil(t, res.UnmarshalJSONTo(out))
+				assert.Equal(t, 3, out.Sum)
+			}
+		}
+	}
+}
+
+func TestClientServerCodec(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerCodec", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("echo", func(req Request, res Response) {
+			var in codecPayload
+
+			if err := req.Bind(&in); err != nil {
+				res.Error(err)
+				return
+			}
+
+			res.Encode(StatusOK, in)
+		})
+
+		go server.ListenAndServe()
+
+		_, err := NewClientWithOptions(b, "TestClientServerCodec", ClientOptions{ContentType: "application/unknown"})
+		assert.NotNil(t, err)
+
+		client, err := NewClientWithOptions(b, "TestClientServerCodec", ClientOptions{
+			DefaultTTL:  time.Second,
+			ContentType: ContentTypeMsgpack,
+		})
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			res, err := client.Call("echo").WithStruct(codecPayload{Name: "x", Value: 10}).Sync()
+
+			if assert.Nil(t, err) {
+				var out codecPayload
+
+				assert.Equal(t, ContentTypeMsgpack, res.ContentType)
+				assert.Nil(t, res.Decode(&out))
+				assert.Equal(t, codecPayload{Name: "x", Value: 10}, out)
+			}
+		}
+	}
+}
+
+func TestClientServerAccept(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerAccept", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("echo", func(req Request, res Response) {
+			var in codecPayload
+
+			_ = req.Bind(&in)
+
+			res.Encode(StatusOK, in)
+		})
+
+		go server.ListenAndServe()
+
+		_, err := NewClientWithOptions(b, "TestClientServerAccept", ClientOptions{Accept: []string{"application/unknown"}})
+		assert.NotNil(t, err)
+
+		client, err := NewClientWithOptions(b, "TestClientServerAccept", ClientOptions{
+			DefaultTTL: time.Second,
+			Accept:     []string{ContentTypeCBOR, ContentTypeJSON},
+		})
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			res, err := client.Call("echo").WithStruct(codecPayload{Name: "x"}).Sync()
+
+			if assert.Nil(t, err) {
+				var out codecPayload
+
+				assert.Equal(t, ContentTypeCBOR, res.ContentType)
+				assert.Nil(t, res.Decode(&out))
+				assert.Equal(t, "x", out.Name)
+			}
+
+			res, err = client.Call("echo").WithStruct(codecPayload{Name: "x"}).WithAccept("application/xml").Sync()
+
+			if assert.Nil(t, err) {
+				var rpcErr *RPCError
+
+				assert.Equal(t, StatusNotAcceptable, res.StatusCode)
+				assert.True(t, errors.As(res.Err(), &rpcErr))
+				assert.Equal(t, ErrorCodeNotAcceptable, rpcErr.Code)
+			}
+		}
+	}
+}
+
+func TestClientServerCompression(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	_, err := NewServer(b, "TestClientServerCompression", Options{Compression: Compression{Encoding: "br"}})
+	assert.NotNil(t, err)
+
+	server, err := NewServer(b, "TestClientServerCompression", Options{
+		AutoAck:     false,
+		Compression: Compression{Encoding: EncodingZstd, Threshold: 512, MaxDecodedSize: 8192},
+	})
+
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("echo", func(req Request, res Response) {
+			res.Raw(StatusOK, "text/plain", req.GetBody())
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClientWithOptions(b, "TestClientServerCompression", ClientOptions{
+			DefaultTTL:  time.Second,
+			Compression: Compression{Encoding: EncodingGzip, Threshold: 512},
+		})
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			for _, size := range []int{10, 4096} {
+				body := bytes.Repeat([]byte("a"), size)
+
+				res, err := client.Call("echo").WithBody(body).Sync()
+
+				if assert.Nil(t, err) {
+					assert.Equal(t, body, res.Content)
+				}
+			}
+
+			// the request decompresses past the server maximum size.
+			res, err := client.Call("echo").WithBody(bytes.Repeat([]byte("a"), 8193)).Sync()
+
+			if assert.Nil(t, err) {
+				var rpcErr *RPCError
+
+				if assert.True(t, errors.As(res.Err(), &rpcErr)) {
+					assert.Equal(t, ErrorCodeInvalidArgument, rpcErr.Code)
+				}
+			}
+		}
+	}
+}
+
+func TestClientServerClaimCheck(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	store, cleanup := newTestFileBlobStore(t)
+	defer cleanup()
+
+	claimCheck := ClaimCheck{Store: store, Threshold: 1024}
+
+	server, err := NewServer(b, "TestClientServerClaimCheck", Options{AutoAck: false, ClaimCheck: claimCheck})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("echo", func(req Request, res Response) {
+			res.Raw(StatusOK, "text/plain", req.GetBody())
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClientWithOptions(b, "TestClientServerClaimCheck", ClientOptions{
+			DefaultTTL: time.Second,
+			ClaimCheck: claimCheck,
+		})
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			body := bytes.Repeat([]byte("a"), 4096)
+
+			res, err := client.Call("echo").WithBody(body).Sync()
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, body, res.Content)
+				assert.NotNil(t, res.Headers.Get(ClaimCheckHeader))
+			}
+
+			// the request blob is deleted by the server once it has replied.
+			deadline := time.Now().Add(time.Second)
+
+			for countBlobs(t, store) > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			assert.Equal(t, 0, countBlobs(t, store))
+		}
+	}
+}
+
+func TestClientServerStream(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerStream", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.RegisterStream("count", func(req Request, stream ResponseStream) error {
+			for i := 0; i < 50; i++ {
+				if err := stream.Send(codecPayload{Value: i}); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		server.RegisterStream("fail", func(req Request, stream ResponseStream) error {
+			if err := stream.Send(codecPayload{}); err != nil {
+				return err
+			}
+
+			return NewInvalidArgumentError("Invalid page.", nil)
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClientWithOptions(b, "TestClientServerStream", ClientOptions{
+			DefaultTTL:   5 * time.Second,
+			StreamWindow: 4,
+		})
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			stream, err := client.Call("count").Stream()
+
+			if assert.Nil(t, err) {
+				var values []int
+
+				for stream.Next() {
+					var out codecPayload
+
+					assert.Nil(t, stream.Chunk().Decode(&out))
+					values = append(values, out.Value)
+				}
+
+				assert.Nil(t, stream.Err())
+				assert.Len(t, values, 50)
+
+				for i, v := range values {
+					assert.Equal(t, i, v)
+				}
+
+				assert.False(t, stream.Next())
+				assert.Nil(t, stream.Close())
+			}
+
+			stream, err = client.Call("fail").Stream()
+
+			if assert.Nil(t, err) {
+				assert.True(t, stream.Next())
+				assert.False(t, stream.Next())
+
+				var rpcErr *RPCError
+
+				if assert.True(t, errors.As(stream.Err(), &rpcErr)) {
+					assert.Equal(t, ErrorCodeInvalidArgument, rpcErr.Code)
+				}
+			}
+		}
+	}
+}
+
+func TestClientServerStreamFlowControl(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientServerStreamFlowControl", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		var sent int32
+
+		canceled := make(chan error, 1)
+
+		server.RegisterStream("list", func(req Request, stream ResponseStream) error {
+			for {
+				if err := stream.SendRaw("text/plain", []byte("chunk")); err != nil {
+					canceled <- err
+					return err
+				}
+
+				atomic.AddInt32(&sent, 1)
+			}
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClientWithOptions(b, "TestClientServerStreamFlowControl", ClientOptions{
+			DefaultTTL:   5 * time.Second,
+			StreamWindow: 2,
+		})
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			stream, err := client.Call("list").Stream()
+
+			if assert.Nil(t, err) {
+				// without credit, the server stops after a window of chunks.
+				time.Sleep(200 * time.Millisecond)
+				assert.Equal(t, int32(2), atomic.LoadInt32(&sent))
+
+				for i := 0; i < 10; i++ {
+					assert.True(t, stream.Next())
+					assert.Equal(t, []byte("chunk"), stream.Chunk().Content)
+				}
+
+				stream.Close()
+
+				assert.False(t, stream.Next())
+				assert.Nil(t, stream.Err())
+
+				select {
+				case err := <-canceled:
+					assert.Equal(t, ErrStreamCanceled, err)
+				case <-time.After(time.Second):
+					t.Error("The server did not stop streaming.")
+				}
+			}
+		}
+	}
+}
+
+func TestClientServerStreamControlLost(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	srv, err := NewServer(b, "TestClientServerStreamControlLost", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer srv.Close()
+
+		stopped := make(chan error, 1)
+
+		srv.RegisterStream("list", func(req Request, stream ResponseStream) error {
+			for {
+				if err := stream.SendRaw("text/plain", []byte("chunk")); err != nil {
+					stopped <- err
+					return err
+				}
+			}
+		})
+
+		go srv.ListenAndServe()
+
+		client, err := NewClientWithOptions(b, "TestClientServerStreamControlLost", ClientOptions{
+			DefaultTTL:   5 * time.Second,
+			StreamWindow: 2,
+		})
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			stream, err := client.Call("list").Stream()
+
+			if assert.Nil(t, err) {
+				defer stream.Close()
+
+				assert.True(t, stream.Next())
+
+				// e.g. the connection was lost, the credits of the client go nowhere.
+				srv.(*server).closeControl()
+
+				select {
+				case err := <-stopped:
+					assert.Equal(t, ErrStreamControlLost, err)
+				case <-time.After(time.Second):
+					t.Fatal("The server did not stop streaming.")
+				}
+
+				for stream.Next() {
+				}
+
+				assert.NotNil(t, stream.Err())
+			}
+		}
+	}
+}
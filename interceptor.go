@@ -0,0 +1,57 @@
+package porthos
+
+import (
+	"context"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Invocation describes an outgoing call as seen by the client interceptors.
+// Interceptors can modify it before calling the next invoker.
+type Invocation struct {
+	ServiceName string
+	Method      string
+	ContentType string
+	Body        []byte
+	Headers     *Headers
+	// Void is set when the call doesn't expect a response.
+	Void bool
+}
+
+// Invoker performs an outgoing call. The response is nil for void calls.
+type Invoker func(ctx context.Context, inv *Invocation) (*ClientResponse, error)
+
+// Interceptor wraps the outgoing calls of a client.
+// It can inspect and modify the invocation, observe the response, its error and latency,
+// or abort the call by returning without calling next.
+type Interceptor func(ctx context.Context, inv *Invocation, next Invoker) (*ClientResponse, error)
+
+// chainInterceptors wraps the invoker with the interceptors, the first one being the outermost.
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+
+		invoker = func(ctx context.Context, inv *Invocation) (*ClientResponse, error) {
+			return interceptor(ctx, inv, next)
+		}
+	}
+
+	return invoker
+}
+
+// publishingHeaders returns the AMQP headers of the invocation.
+func (inv *Invocation) publishingHeaders(publishedAt time.Time) amqp.Table {
+	headers := amqp.Table{}
+
+	if inv.Headers != nil {
+		for k, v := range inv.Headers.asMap() {
+			headers[k] = v
+		}
+	}
+
+	headers["X-Method"] = inv.Method
+	headers["X-Published-At"] = unixMilliseconds(publishedAt)
+
+	return headers
+}
@@ -0,0 +1,123 @@
+package porthos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientInterceptors(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestClientInterceptors", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("echo", func(req Request, res Response) {
+			res.Raw(StatusOK, "text/plain", req.GetBody())
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestClientInterceptors", time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			var observed []int32
+			errAborted := errors.New("aborted")
+
+			client.Use(func(ctx context.Context, inv *Invocation, next Invoker) (*ClientResponse, error) {
+				if inv.Method == "forbidden" {
+					return nil, errAborted
+				}
+
+				res, err := next(ctx, inv)
+
+				if res != nil {
+					observed = append(observed, res.StatusCode)
+				}
+
+				return res, err
+			})
+
+			client.Use(func(ctx context.Context, inv *Invocation, next Invoker) (*ClientResponse, error) {
+				inv.Body = append(inv.Body, []byte(" intercepted")...)
+				return next(ctx, inv)
+			})
+
+			res, err := client.Call("echo").WithBody([]byte("body")).Sync()
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, "body intercepted", string(res.Content))
+			}
+
+			slot, err := client.Call("echo").WithBody([]byte("async")).Async()
+
+			if assert.Nil(t, err) {
+				defer slot.Dispose()
+
+				select {
+				case res := <-slot.ResponseChannel():
+					assert.Equal(t, "async intercepted", string(res.Content))
+				case <-time.After(time.Second):
+					t.Error("No response received. Timedout.")
+				}
+			}
+
+			_, err = client.Call("forbidden").Sync()
+			assert.Equal(t, errAborted, err)
+
+			_, err = client.Call("forbidden").Async()
+			assert.Equal(t, errAborted, err)
+
+			assert.Equal(t, errAborted, client.Call("forbidden").Void())
+
+			assert.Equal(t, []int32{StatusOK, StatusOK}, observed)
+		}
+	}
+}
+
+func TestClientInterceptorsAsyncTimeout(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	// nobody consumes the requests.
+	client, err := NewClient(b, "TestClientInterceptorsAsyncTimeout", time.Second)
+
+	if assert.Nil(t, err, "Failed to create client.") {
+		defer client.Close()
+
+		errs := make(chan error, 1)
+
+		client.Use(func(ctx context.Context, inv *Invocation, next Invoker) (*ClientResponse, error) {
+			res, err := next(ctx, inv)
+			errs <- err
+			return res, err
+		})
+
+		slot, err := client.Call("method").WithTimeout(50 * time.Millisecond).Async()
+
+		if assert.Nil(t, err) {
+			responses := slot.ResponseChannel()
+
+			select {
+			case err := <-errs:
+				assert.Equal(t, context.DeadlineExceeded, err)
+			case <-time.After(time.Second):
+				t.Fatal("The interceptor did not time out.")
+			}
+
+			select {
+			case _, ok := <-responses:
+				assert.False(t, ok, "The slot should be disposed.")
+			case <-time.After(time.Second):
+				t.Error("The slot was not disposed.")
+			}
+		}
+	}
+}
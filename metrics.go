@@ -18,7 +18,7 @@ type metricEntry struct {
 }
 
 type metricsCollector struct {
-	channel *amqp.Channel
+	channel Channel
 	index   int
 	buffer  []*metricEntry
 }
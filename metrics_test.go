@@ -1,13 +1,14 @@
 package porthos
 
 import (
-	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestMetricsShipperExtension(t *testing.T) {
-	b, _ := NewBroker(os.Getenv("AMQP_URL"))
+	b := newTestBroker(t)
+	defer b.Close()
 
 	ext, err := NewMetricsShipperExtension(b, MetricsShipperConfig{BufferSize: 2})
 
@@ -34,17 +35,17 @@ func TestMetricsShipperExtension(t *testing.T) {
 		nil,               // args
 	)
 
-	shippedMetricsCount := 0
+	var shippedMetricsCount int32
 
 	go func() {
 		for range dc {
-			shippedMetricsCount++
+			atomic.AddInt32(&shippedMetricsCount, 1)
 		}
 	}()
 
 	<-time.After(2 * time.Second)
 
-	if shippedMetricsCount != 3 {
-		t.Errorf("Excepted 3 shipped metrics, got %d", shippedMetricsCount)
+	if count := atomic.LoadInt32(&shippedMetricsCount); count != 3 {
+		t.Errorf("Excepted 3 shipped metrics, got %d", count)
 	}
 }
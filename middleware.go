@@ -0,0 +1,15 @@
+package porthos
+
+// Middleware wraps a method handler.
+// It can inspect or modify the request (see Request.WithContext), write the response
+// and skip the wrapped handler, which makes it suitable for auth, validation, caching, etc.
+type Middleware func(MethodHandler) MethodHandler
+
+// chain wraps the handler with the middlewares, the first one being the outermost.
+func chain(handler MethodHandler, middlewares []Middleware) MethodHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
@@ -0,0 +1,130 @@
+package porthos
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+
+	middleware := func(name string) Middleware {
+		return func(next MethodHandler) MethodHandler {
+			return func(req Request, res Response) {
+				calls = append(calls, name)
+				next(req, res)
+			}
+		}
+	}
+
+	handler := chain(func(req Request, res Response) {
+		calls = append(calls, "handler")
+	}, []Middleware{middleware("first"), middleware("second")})
+
+	handler(&request{}, newResponse())
+
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+}
+
+type tenantKey struct{}
+
+func TestServerMiddlewares(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestServerMiddlewares", Options{AutoAck: false})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		// global middleware that enriches the request.
+		server.Use(func(next MethodHandler) MethodHandler {
+			return func(req Request, res Response) {
+				next(req.WithContext(context.WithValue(req.Context(), tenantKey{}, "tenant")), res)
+			}
+		})
+
+		// per method middleware that short-circuits the request.
+		forbidden := func(next MethodHandler) MethodHandler {
+			return func(req Request, res Response) {
+				res.Empty(StatusForbidden)
+			}
+		}
+
+		server.Register("tenant", func(req Request, res Response) {
+			res.Raw(StatusOK, "text/plain", []byte(req.Context().Value(tenantKey{}).(string)))
+		})
+
+		server.Register("forbidden", func(req Request, res Response) {
+			t.Error("Handler must not be invoked.")
+		}, forbidden)
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestServerMiddlewares", time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			res, err := client.Call("tenant").Sync()
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, StatusOK, res.StatusCode)
+				assert.Equal(t, "tenant", string(res.Content))
+			}
+
+			res, err = client.Call("forbidden").Sync()
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, StatusForbidden, res.StatusCode)
+			}
+		}
+	}
+}
+
+func TestServerUseWhileServing(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	server, err := NewServer(b, "TestServerUseWhileServing", Options{AutoAck: false, Concurrency: 4})
+	if assert.Nil(t, err, "Failed to create server.") {
+		defer server.Close()
+
+		server.Register("method", func(req Request, res Response) {
+			res.Empty(StatusOK)
+		})
+
+		go server.ListenAndServe()
+
+		client, err := NewClient(b, "TestServerUseWhileServing", time.Second)
+
+		if assert.Nil(t, err, "Failed to create client.") {
+			defer client.Close()
+
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+
+				for i := 0; i < 10; i++ {
+					server.Use(func(next MethodHandler) MethodHandler {
+						return next
+					})
+					server.Register("other", func(req Request, res Response) {})
+				}
+			}()
+
+			for i := 0; i < 10; i++ {
+				res, err := client.Call("method").Sync()
+
+				if assert.Nil(t, err) {
+					assert.Equal(t, StatusOK, res.StatusCode)
+				}
+			}
+
+			<-done
+		}
+	}
+}
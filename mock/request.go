@@ -1,10 +1,8 @@
 package mock
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 
 	"github.com/porthos-rpc/porthos-go"
 )
@@ -14,6 +12,7 @@ type Request struct {
 	MethodName  string
 	ContentType string
 	Body        []byte
+	Headers     *porthos.Headers
 	ctx         context.Context
 }
 
@@ -29,18 +28,20 @@ func (r *Request) GetBody() []byte {
 	return r.Body
 }
 
+func (r *Request) GetHeaders() *porthos.Headers {
+	if r.Headers == nil {
+		r.Headers = porthos.NewHeaders()
+	}
+
+	return r.Headers
+}
+
 func (r *Request) Form() (porthos.Form, error) {
 	return porthos.NewForm(r.ContentType, r.Body)
 }
 
 func (r *Request) Bind(i interface{}) error {
-	if r.ContentType != "application/json" {
-		return fmt.Errorf("Invalid content type, got: %s", r.ContentType)
-	}
-
-	decoder := json.NewDecoder(bytes.NewReader(r.Body))
-	decoder.UseNumber()
-	return decoder.Decode(i)
+	return porthos.Unmarshal(r.ContentType, r.Body, i)
 }
 
 func (r *Request) WithContext(ctx context.Context) porthos.Request {
@@ -69,6 +70,7 @@ func NewRequest(service, method string, contentType string, body []byte) porthos
 		MethodName:  method,
 		ContentType: contentType,
 		Body:        body,
+		Headers:     porthos.NewHeaders(),
 	}
 }
 
@@ -25,6 +25,11 @@ func (r *Response) JSON(statusCode int32, Body interface{}) {
 	r.ContentType = "application/json"
 }
 
+// Encode sets the content of the response as JSON, like JSON.
+func (r *Response) Encode(statusCode int32, body interface{}) {
+	r.JSON(statusCode, body)
+}
+
 func (r *Response) Raw(statusCode int32, contentType string, body []byte) {
 	r.StatusCode = statusCode
 	r.Body = body
@@ -35,6 +40,12 @@ func (r *Response) Empty(statusCode int32) {
 	r.StatusCode = statusCode
 }
 
+func (r *Response) Error(err error) {
+	rpcErr := porthos.ToRPCError(err)
+
+	r.JSON(rpcErr.StatusCode, rpcErr)
+}
+
 func (r *Response) GetHeaders() *porthos.Headers {
 	return r.Headers
 }
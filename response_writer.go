@@ -1,6 +1,9 @@
 package porthos
 
 import (
+	"context"
+	"time"
+
 	"github.com/streadway/amqp"
 )
 
@@ -9,39 +12,78 @@ type ResponseWriter interface {
 	Write(res Response) error
 }
 
+// publisher sends messages and waits for the broker confirmation.
+type publisher interface {
+	publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error
+}
+
 type responseWriter struct {
-	channel  *amqp.Channel
-	autoAck  bool
-	delivery amqp.Delivery
+	publisher publisher
+	autoAck   bool
+	delivery  amqp.Delivery
+	// deadline of the request, the caller doesn't wait for the response after it.
+	deadline time.Time
+	// compression of the response body.
+	compression Compression
+	// claimCheck offloads the response body if it is too large.
+	claimCheck ClaimCheck
 }
 
 func (rw *responseWriter) Write(res Response) error {
-	if rw.channel == nil {
+	err := rw.publish(res)
+
+	if err != nil {
+		return err
+	}
+
+	if !rw.autoAck {
+		rw.delivery.Ack(false)
+	}
+
+	return nil
+}
+
+// publish sends the response without acking the delivery, until the request deadline.
+func (rw *responseWriter) publish(res Response) error {
+	ctx := context.Background()
+
+	if !rw.deadline.IsZero() {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithDeadline(ctx, rw.deadline)
+		defer cancel()
+	}
+
+	return rw.publishContext(ctx, res)
+}
+
+// publishContext sends the response without acking the delivery, until the context is done.
+func (rw *responseWriter) publishContext(ctx context.Context, res Response) error {
+	if rw.publisher == nil {
 		return ErrNilPublishChannel
 	}
 
 	// status code is a header as well.
 	res.GetHeaders().Set("statusCode", res.GetStatusCode())
 
-	err := rw.channel.Publish(
-		"",
-		rw.delivery.ReplyTo,
-		false,
-		false,
-		amqp.Publishing{
-			Headers:       res.GetHeaders().asMap(),
-			ContentType:   res.GetContentType(),
-			CorrelationId: rw.delivery.CorrelationId,
-			Body:          res.GetBody(),
-		})
+	body, encoding := res.GetBody(), ""
 
-	if err != nil {
-		return err
+	// callers that don't accept the encoding get the body as is.
+	if accept, _ := rw.delivery.Headers[AcceptEncodingHeader].(string); acceptsEncoding(accept, rw.compression.Encoding) {
+		var err error
+
+		if body, encoding, err = rw.compression.compress(body); err != nil {
+			return err
+		}
 	}
 
-	if !rw.autoAck {
-		rw.delivery.Ack(false)
+	msg := amqp.Publishing{
+		Headers:         res.GetHeaders().asMap(),
+		ContentType:     res.GetContentType(),
+		ContentEncoding: encoding,
+		CorrelationId:   rw.delivery.CorrelationId,
+		Body:            body,
 	}
 
-	return nil
+	return rw.claimCheck.publish(ctx, rw.publisher, "", rw.delivery.ReplyTo, msg)
 }
@@ -1,8 +1,9 @@
 package porthos
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"os"
 	"testing"
 	"time"
 
@@ -14,7 +15,9 @@ type ResponseExample struct {
 }
 
 func TestResponseWriterJSON(t *testing.T) {
-	b, _ := NewBroker(os.Getenv("AMQP_URL"))
+	b := newTestBroker(t)
+	defer b.Close()
+
 	ch, _ := b.openChannel()
 	q, _ := ch.QueueDeclare("", false, false, true, false, nil)
 	dc, _ := ch.Consume(q.Name, "", true, false, false, false, nil)
@@ -23,8 +26,8 @@ func TestResponseWriterJSON(t *testing.T) {
 	response.JSON(200, ResponseExample{Sum: 10})
 
 	rw := &responseWriter{
-		channel: ch,
-		autoAck: true,
+		publisher: b.publishers,
+		autoAck:   true,
 		delivery: amqp.Delivery{
 			ReplyTo:       q.Name,
 			CorrelationId: "correlationId",
@@ -57,7 +60,9 @@ func TestResponseWriterJSON(t *testing.T) {
 }
 
 func TestResponseWriterRaw(t *testing.T) {
-	b, _ := NewBroker(os.Getenv("AMQP_URL"))
+	b := newTestBroker(t)
+	defer b.Close()
+
 	ch, _ := b.openChannel()
 	q, _ := ch.QueueDeclare("", false, false, true, false, nil)
 	dc, _ := ch.Consume(q.Name, "", true, false, false, false, nil)
@@ -66,8 +71,8 @@ func TestResponseWriterRaw(t *testing.T) {
 	response.Raw(201, "text/plain", []byte("Some Response Text"))
 
 	rw := &responseWriter{
-		channel: ch,
-		autoAck: true,
+		publisher: b.publishers,
+		autoAck:   true,
 		delivery: amqp.Delivery{
 			ReplyTo:       q.Name,
 			CorrelationId: "correlationId",
@@ -97,7 +102,9 @@ func TestResponseWriterRaw(t *testing.T) {
 }
 
 func TestResponseWriterEmpty(t *testing.T) {
-	b, _ := NewBroker(os.Getenv("AMQP_URL"))
+	b := newTestBroker(t)
+	defer b.Close()
+
 	ch, _ := b.openChannel()
 	q, _ := ch.QueueDeclare("", false, false, true, false, nil)
 	dc, _ := ch.Consume(q.Name, "", true, false, false, false, nil)
@@ -106,8 +113,8 @@ func TestResponseWriterEmpty(t *testing.T) {
 	response.Empty(202)
 
 	rw := &responseWriter{
-		channel: ch,
-		autoAck: true,
+		publisher: b.publishers,
+		autoAck:   true,
 		delivery: amqp.Delivery{
 			ReplyTo:       q.Name,
 			CorrelationId: "correlationId",
@@ -135,3 +142,93 @@ func TestResponseWriterEmpty(t *testing.T) {
 		t.Fatal("No response receive. Timedout.")
 	}
 }
+
+func TestResponseWriterCompression(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	ch, _ := b.openChannel()
+	q, _ := ch.QueueDeclare("", false, false, true, false, nil)
+	dc, _ := ch.Consume(q.Name, "", true, false, false, false, nil)
+
+	body := bytes.Repeat([]byte("Some Response Text"), 100)
+
+	response := newResponse()
+	response.Raw(200, "text/plain", body)
+
+	rw := &responseWriter{
+		publisher:   b.publishers,
+		autoAck:     true,
+		compression: Compression{Encoding: EncodingSnappy},
+		delivery: amqp.Delivery{
+			ReplyTo:       q.Name,
+			CorrelationId: "correlationId",
+			Headers:       amqp.Table{AcceptEncodingHeader: "gzip, snappy"},
+		},
+	}
+
+	rw.Write(response)
+
+	select {
+	case response := <-dc:
+		if response.ContentEncoding != EncodingSnappy {
+			t.Errorf("Expected content encoding snappy, got: %s", response.ContentEncoding)
+		}
+
+		decompressed, err := Compression{}.decompress(response.ContentEncoding, response.Body)
+
+		if err != nil || !bytes.Equal(decompressed, body) {
+			t.Errorf("Response failed, expected the original body, got: %s", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("No response receive. Timedout.")
+	}
+
+	// the caller does not accept the encoding.
+	rw.delivery.Headers = amqp.Table{AcceptEncodingHeader: EncodingGzip}
+	rw.Write(response)
+
+	select {
+	case response := <-dc:
+		if response.ContentEncoding != "" || !bytes.Equal(response.Body, body) {
+			t.Errorf("Expected the body as is, got content encoding: %s", response.ContentEncoding)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("No response receive. Timedout.")
+	}
+}
+
+func TestResponseWriterDeadline(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	b, err := NewBrokerConfig("memory://", Config{
+		Transport:      transport,
+		BlockedTimeout: time.Minute,
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to create the memory broker: %s", err)
+	}
+
+	defer b.Close()
+
+	blockBroker(t, b, transport)
+
+	rw := &responseWriter{
+		publisher: b,
+		autoAck:   true,
+		deadline:  time.Now().Add(50 * time.Millisecond),
+		delivery: amqp.Delivery{
+			ReplyTo:       "reply",
+			CorrelationId: "correlationId",
+		},
+	}
+
+	response := newResponse()
+	response.Empty(200)
+
+	// the reply waits for the broker to unblock, but not after the caller gave up.
+	if err := rw.Write(response); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to be exceeded, got: %v", err)
+	}
+}
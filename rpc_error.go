@@ -0,0 +1,96 @@
+package porthos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Codes of the errors produced by porthos itself. Services are free to define their own.
+const (
+	// ErrorCodeInternal is used for panics and errors that are not an *RPCError.
+	ErrorCodeInternal = "internal_error"
+	// ErrorCodeMethodNotFound is used when the called method is not registered.
+	ErrorCodeMethodNotFound = "method_not_found"
+	// ErrorCodeInvalidArgument is used when the request can not be decoded or is not valid.
+	ErrorCodeInvalidArgument = "invalid_argument"
+	// ErrorCodeNotAcceptable is used when the response can not be encoded in any content type accepted by the caller.
+	ErrorCodeNotAcceptable = "not_acceptable"
+	// ErrorCodeDeadlineExceeded is used when the request deadline is exceeded while handling it.
+	ErrorCodeDeadlineExceeded = "deadline_exceeded"
+	// ErrorCodeUnknown is used when an error response does not carry the error envelope.
+	ErrorCodeUnknown = "unknown"
+)
+
+// RPCError is the standard error of a rpc response. It is sent as a JSON envelope:
+//
+//     {"code": "invalid_argument", "message": "...", "details": {...}, "retryable": false}
+//
+// along with an error status code, so it can be produced and consumed in any language.
+type RPCError struct {
+	// StatusCode of the response, it is not part of the envelope.
+	StatusCode int32 `json:"-"`
+	// Code is a stable, machine readable identifier of the error.
+	Code string `json:"code"`
+	// Message is a human readable description of the error.
+	Message string `json:"message"`
+	// Details holds any additional data about the error.
+	Details map[string]interface{} `json:"details,omitempty"`
+	// Retryable tells whether calling again may succeed.
+	Retryable bool `json:"retryable"`
+}
+
+// NewRPCError creates a new RPCError.
+func NewRPCError(statusCode int32, code, message string) *RPCError {
+	return &RPCError{StatusCode: statusCode, Code: code, Message: message}
+}
+
+// NewInvalidArgumentError creates the error of a request that can not be decoded or is not valid.
+func NewInvalidArgumentError(message string, details map[string]interface{}) *RPCError {
+	return &RPCError{StatusCode: StatusBadRequest, Code: ErrorCodeInvalidArgument, Message: message, Details: details}
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// NewInternalError creates the generic error replied for panics and errors that are not an *RPCError.
+func NewInternalError() *RPCError {
+	return NewRPCError(StatusInternalServerError, ErrorCodeInternal, "Internal server error.")
+}
+
+// ToRPCError returns the error replied for err: err itself if it is (or wraps) an *RPCError,
+// otherwise the generic internal error, so the callers don't see its possibly sensitive details.
+func ToRPCError(err error) *RPCError {
+	var rpcErr *RPCError
+
+	if errors.As(err, &rpcErr) {
+		if rpcErr.StatusCode == 0 {
+			copied := *rpcErr
+			copied.StatusCode = StatusInternalServerError
+
+			return &copied
+		}
+
+		return rpcErr
+	}
+
+	return NewInternalError()
+}
+
+// decodeRPCError decodes the error envelope of a response.
+// Responses without the envelope result in an ErrorCodeUnknown error.
+func decodeRPCError(statusCode int32, contentType string, body []byte) *RPCError {
+	rpcErr := &RPCError{}
+
+	if contentType != "application/json" || json.Unmarshal(body, rpcErr) != nil || rpcErr.Code == "" {
+		rpcErr = &RPCError{
+			Code:    ErrorCodeUnknown,
+			Message: fmt.Sprintf("Request failed with status code %d.", statusCode),
+		}
+	}
+
+	rpcErr.StatusCode = statusCode
+
+	return rpcErr
+}
@@ -0,0 +1,31 @@
+package porthos
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToRPCError(t *testing.T) {
+	rpcErr := NewInvalidArgumentError("Value must be positive.", nil)
+
+	assert.Equal(t, rpcErr, ToRPCError(rpcErr))
+	assert.Equal(t, rpcErr, ToRPCError(fmt.Errorf("validating: %w", rpcErr)))
+
+	// without status code, it is an internal error.
+	assert.Equal(t, StatusInternalServerError, ToRPCError(&RPCError{Code: "custom"}).StatusCode)
+
+	// the details of other errors are not replied.
+	assert.Equal(t, NewInternalError(), ToRPCError(errors.New("database password is wrong")))
+	assert.Equal(t, NewInternalError(), ToRPCError(nil))
+}
+
+func TestResponseErrorNil(t *testing.T) {
+	res := newResponse()
+	res.Error(nil)
+
+	assert.Equal(t, StatusInternalServerError, res.GetStatusCode())
+	assert.JSONEq(t, `{"code": "internal_error", "message": "Internal server error.", "retryable": false}`, string(res.GetBody()))
+}
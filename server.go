@@ -1,8 +1,12 @@
 package porthos
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"runtime/debug"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,10 +18,20 @@ type MethodHandler func(req Request, res Response)
 
 // Server is used to register procedures to be invoked remotely.
 type Server interface {
-	// Register a method and its handler.
-	Register(method string, handler MethodHandler)
-	// Register a method, it's handler and it's specification.
-	RegisterWithSpec(method string, handler MethodHandler, spec Spec)
+	// Register a method and its handler, wrapped by the given middlewares.
+	Register(method string, handler MethodHandler, middlewares ...Middleware)
+	// Register a method, it's handler and it's specification, wrapped by the given middlewares.
+	RegisterWithSpec(method string, handler MethodHandler, spec Spec, middlewares ...Middleware)
+	// RegisterFunc registers a function like func(ctx context.Context, in *In) (*Out, error)
+	// as the method handler, deriving its spec. See NewFuncHandler.
+	RegisterFunc(method string, fn interface{}, middlewares ...Middleware) error
+	// RegisterStream registers a streaming method, whose handler sends many chunks
+	// to the caller, wrapped by the given middlewares.
+	RegisterStream(method string, handler StreamHandler, middlewares ...Middleware)
+	// Use adds middlewares wrapping the handlers of all methods.
+	// They run before the middlewares given to Register. Requests already being handled
+	// keep the middlewares they started with.
+	Use(middlewares ...Middleware)
 	// AddExtension adds extensions to the server instance.
 	// Extensions can be used to add custom actions to incoming and outgoing RPC calls.
 	AddExtension(ext Extension)
@@ -30,47 +44,109 @@ type Server interface {
 	// Close closes the client and AMQP channel.
 	// This method returns right after the AMQP channel is closed.
 	// In order to give time to the current request to finish (if there's any)
-	// it's up to you to wait using the NotifyClose.
+	// it's up to you to wait using the NotifyClose, or to use Shutdown instead.
 	Close()
-	// Shutdown shuts down the client and AMQP channel.
-	// It provider graceful shutdown, since it will wait the result
-	// of <-s.NotifyClose().
-	Shutdown()
+	// Shutdown gracefully shuts down the server: it stops consuming, waits for the
+	// requests being handled to complete and their responses to be confirmed, and then
+	// closes the AMQP channel. If the context is done first, the remaining requests are
+	// nacked to be requeued, the channel is closed and the context error is returned.
+	Shutdown(ctx context.Context) error
 	// NotifyClose returns a channel to be notified when this server closes.
 	NotifyClose() <-chan bool
+	// Done returns a channel closed when ListenAndServe returns, or when the server
+	// is closed before serving. See Err.
+	Done() <-chan struct{}
+	// Err returns why the server stopped serving: ErrServerClosed, ErrBrokerClosed or
+	// ErrRetriesExhausted when reconnecting gave up. It returns nil while serving.
+	Err() error
 }
 
 type server struct {
 	m              sync.Mutex
 	broker         *Broker
 	serviceName    string
-	channel        *amqp.Channel
+	channel        Channel
+	consumerTag    string
 	requestChannel <-chan amqp.Delivery
 	methods        map[string]MethodHandler
+	middlewares    []Middleware
 	specs          map[string]Spec
 	autoAck        bool
+	concurrency    int
+	prefetchCount  int
 	extensions     []Extension
 	topologySet    bool
-
-	closed bool
-	closes []chan bool
+	compression    Compression
+	claimCheck     ClaimCheck
+
+	streamsLock    sync.Mutex
+	streams        map[string]*responseStream
+	controlQueue   string
+	controlChannel Channel
+	// controlDeclared is closed once the control queue being declared is ready, nil if none is.
+	controlDeclared chan struct{}
+
+	closed    bool
+	abandoned bool
+	serving   bool
+	stop      chan struct{}
+	done      chan struct{}
+	closes    []chan bool
+	err       error
+	// finished makes the server finish once, by serve or by a close before serving.
+	finished sync.Once
 }
 
 // Options represent all the options supported by the server.
 type Options struct {
 	AutoAck bool
+	// Concurrency is the number of workers handling requests, defaults to DefaultConcurrency.
+	Concurrency int
+	// PrefetchCount is the number of unacked requests the broker delivers to this server,
+	// defaults to Concurrency. It has no effect when AutoAck is enabled.
+	PrefetchCount int
+	// Compression of the response bodies, disabled by default. Its MaxDecodedSize limits
+	// the decompressed request bodies, larger ones are replied as invalid arguments.
+	Compression Compression
+	// ClaimCheck offloads the large response bodies and resolves the offloaded request ones.
+	ClaimCheck ClaimCheck
 }
 
+// DefaultConcurrency is the number of workers of a server when Options.Concurrency is not set.
+const DefaultConcurrency = 10
+
 var servePollInterval = 500 * time.Millisecond
 
 // NewServer creates a new instance of Server, responsible for executing remote calls.
 func NewServer(b *Broker, serviceName string, options Options) (Server, error) {
+	if err := options.Compression.validate(); err != nil {
+		return nil, err
+	}
+
 	s := &server{
 		broker:      b,
 		serviceName: serviceName,
 		methods:     make(map[string]MethodHandler),
 		specs:       make(map[string]Spec),
+		streams:     make(map[string]*responseStream),
 		autoAck:     options.AutoAck,
+		consumerTag: newUniqueQueueName(serviceName),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		compression: options.Compression,
+		claimCheck:  options.ClaimCheck,
+	}
+
+	s.concurrency = options.Concurrency
+
+	if s.concurrency <= 0 {
+		s.concurrency = DefaultConcurrency
+	}
+
+	s.prefetchCount = options.PrefetchCount
+
+	if s.prefetchCount <= 0 {
+		s.prefetchCount = s.concurrency
 	}
 
 	err := s.setupTopology()
@@ -86,6 +162,10 @@ func (s *server) setupTopology() error {
 	s.m.Lock()
 	defer s.m.Unlock()
 
+	if s.closed {
+		return ErrServerClosed
+	}
+
 	var err error
 	s.channel, err = s.broker.openChannel()
 
@@ -93,6 +173,17 @@ func (s *server) setupTopology() error {
 		return err
 	}
 
+	err = s.channel.Qos(
+		s.prefetchCount, // prefetch count
+		0,               // prefetch size
+		false,           // global
+	)
+
+	if err != nil {
+		s.channel.Close()
+		return err
+	}
+
 	// create the response queue
 	_, err = s.channel.QueueDeclare(
 		s.serviceName, // name
@@ -110,7 +201,7 @@ func (s *server) setupTopology() error {
 
 	s.requestChannel, err = s.channel.Consume(
 		s.serviceName, // queue
-		"",            // consumer
+		s.consumerTag, // consumer
 		s.autoAck,     // auto-ack
 		false,         // exclusive
 		false,         // no-local
@@ -129,11 +220,35 @@ func (s *server) setupTopology() error {
 }
 
 func (s *server) serve() {
+	s.m.Lock()
+
+	if s.serving {
+		s.m.Unlock()
+		return
+	}
+
+	if s.closed {
+		s.m.Unlock()
+		s.finish(ErrServerClosed)
+		return
+	}
+
+	s.serving = true
+	s.m.Unlock()
+
 	notifyCh := s.broker.NotifyReestablish()
+	defer s.broker.StopNotifyReestablish(notifyCh)
+	backoff := s.broker.config.Backoff
+	attempt := 0
 
-	for !s.closed {
+	// the broker stops for good when closed or when it gives up reconnecting.
+	for !s.isClosed() && s.broker.Err() == nil {
 		if !s.broker.IsConnected() {
-			<-notifyCh
+			select {
+			case <-notifyCh:
+			case <-s.broker.Done():
+			case <-s.stop:
+			}
 
 			continue
 		}
@@ -141,8 +256,25 @@ func (s *server) serve() {
 		if !s.topologySet {
 			err := s.setupTopology()
 
-			if err != nil {
-				log.Printf("[PORTHOS] Error setting up topology after reconnection [%s]", err)
+			if err == nil || err == ErrServerClosed {
+				attempt = 0
+				continue
+			}
+
+			attempt++
+
+			if backoff.Exhausted(attempt) {
+				log.Printf("[PORTHOS] Error setting up topology after reconnection, attempt %d. Giving up. [%s]", attempt, err)
+				break
+			}
+
+			log.Printf("[PORTHOS] Error setting up topology after reconnection, attempt %d [%s]", attempt, err)
+
+			select {
+			case <-notifyCh:
+			case <-s.broker.Done():
+			case <-s.stop:
+			case <-time.After(backoff.Delay(attempt - 1)):
 			}
 
 			continue
@@ -153,75 +285,303 @@ func (s *server) serve() {
 
 		log.Printf("[PORTHOS] Connected to the broker and waiting for incoming rpc requests...")
 
-		for d := range s.requestChannel {
-			go func(d amqp.Delivery) {
-				err := s.processRequest(d)
+		s.work(s.requestChannel)
 
-				if err != nil {
-					log.Printf("[PORTHOS] Error processing request: %s", err)
-				}
-			}(d)
+		s.topologySet = false
+	}
+
+	var err error
+
+	switch {
+	case s.isClosed():
+		err = ErrServerClosed
+	case s.broker.Err() != nil:
+		err = s.broker.Err()
+		log.Printf("[PORTHOS] Broker stopped, no longer serving requests [%s]", err)
+	default:
+		// gave up setting up the topology.
+		err = ErrRetriesExhausted
+	}
+
+	s.finish(err)
+}
+
+// finish signals that the server stopped serving because of the error.
+func (s *server) finish(err error) {
+	s.finished.Do(func() {
+		s.m.Lock()
+		defer s.m.Unlock()
+
+		s.err = err
+		close(s.done)
+
+		for _, c := range s.closes {
+			select {
+			case c <- true:
+			default:
+			}
 		}
+	})
+}
 
-		s.topologySet = false
+// work handles the deliveries using a fixed number of workers, until the channel closes.
+func (s *server) work(deliveries <-chan amqp.Delivery) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < s.concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for d := range deliveries {
+				// the shutdown deadline passed, let another server handle it.
+				if s.isAbandoned() {
+					if !s.autoAck {
+						d.Nack(false, true)
+					}
+
+					continue
+				}
+
+				s.handle(d)
+			}
+		}()
 	}
 
-	for _, c := range s.closes {
-		c <- true
+	wg.Wait()
+}
+
+// handle processes the request, making sure its delivery is settled whatever happens.
+func (s *server) handle(d amqp.Delivery) {
+	st := &settlement{Acknowledger: d.Acknowledger}
+	d.Acknowledger = st
+
+	err := s.processRequest(d)
+
+	if err != nil {
+		log.Printf("[PORTHOS] Error processing request: %s", err)
+	}
+
+	// e.g. the reply failed: an unsettled delivery would hold a prefetch slot until the channel closes.
+	if !s.autoAck && !st.settled {
+		d.Reject(false)
+	}
+
+	// a delivery that could not be settled is redelivered, its offloaded body is still needed.
+	if st.err == nil {
+		s.claimCheck.release(context.Background(), d.Headers)
 	}
 }
 
+// settlement records whether a delivery was acked, nacked or rejected, and the error doing it.
+type settlement struct {
+	amqp.Acknowledger
+	settled bool
+	err     error
+}
+
+func (st *settlement) Ack(tag uint64, multiple bool) error {
+	return st.record(st.Acknowledger.Ack(tag, multiple))
+}
+
+func (st *settlement) Nack(tag uint64, multiple bool, requeue bool) error {
+	return st.record(st.Acknowledger.Nack(tag, multiple, requeue))
+}
+
+func (st *settlement) Reject(tag uint64, requeue bool) error {
+	return st.record(st.Acknowledger.Reject(tag, requeue))
+}
+
+func (st *settlement) record(err error) error {
+	st.settled = true
+	st.err = err
+
+	return err
+}
+
 func (s *server) printRegisteredMethods() {
 	log.Printf("[PORTHOS] [%s]", s.serviceName)
 
+	s.m.Lock()
+	defer s.m.Unlock()
+
 	for method := range s.methods {
 		log.Printf("[PORTHOS] . %s", method)
 	}
 }
 
 func (s *server) processRequest(d amqp.Delivery) error {
-	methodName := d.Headers["X-Method"].(string)
+	methodName, _ := d.Headers["X-Method"].(string)
 
-	if method, ok := s.methods[methodName]; ok {
-		req := &request{s.serviceName, methodName, d.ContentType, d.Body, nil}
+	body, err := s.claimCheck.resolve(context.Background(), d.Headers, d.Body)
 
-		res := newResponse()
-		method(req, res)
+	if err == nil {
+		body, err = s.compression.decompress(d.ContentEncoding, body)
+	}
 
-		ch, err := s.broker.openChannel()
+	if err != nil {
+		message := fmt.Sprintf("Invalid body of method '%s': %s", methodName, err)
 
-		if err != nil {
-			return fmt.Errorf("Error opening channel for response: %s", err)
+		if d.ReplyTo != "" {
+			if err := s.reply(d, newErrorResponse(NewInvalidArgumentError(message, nil)), false); err != nil {
+				return err
+			}
 		}
 
-		if err := ch.Confirm(false); err != nil {
-			return fmt.Errorf("Channel could not be put into confirm mode: %s", err)
+		if !s.autoAck {
+			d.Reject(false)
 		}
 
-		confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		return errors.New(message)
+	}
 
-		defer ch.Close()
+	if method, ok := s.method(methodName); ok {
+		ctx := context.Background()
+		deadline, hasDeadline := requestDeadline(d)
 
-		resWriter := &responseWriter{delivery: d, channel: ch, autoAck: s.autoAck}
-		err = resWriter.Write(res)
+		if hasDeadline {
+			var cancel context.CancelFunc
 
-		if err != nil {
-			return fmt.Errorf("Error writing response: %s", err)
-		} else {
-			if confirmed := <-confirms; !confirmed.Ack {
-				return ErrNotAcked
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+
+		req := &request{
+			serviceName: s.serviceName,
+			methodName:  methodName,
+			contentType: d.ContentType,
+			body:        body,
+			headers:     NewHeadersFromMap(d.Headers),
+			ctx:         ctx,
+			delivery:    d,
+		}
+
+		// the caller has already given up, there's no point in handling it.
+		if hasDeadline && !time.Now().Before(deadline) {
+			if !s.autoAck {
+				d.Reject(false)
 			}
+
+			s.pipeThroughFailedExtensions(req, ErrRequestExpired)
+
+			return fmt.Errorf("Method '%s' expired %s ago: %s", methodName, time.Since(deadline), ErrRequestExpired)
 		}
+
+		res := newResponseTo(req)
+
+		if err := s.invoke(s.decorate(method), req, res); err != nil {
+			log.Printf("[PORTHOS] Method '%s' panicked: %s\n%s", methodName, err, err.Stack)
+
+			s.pipeThroughFailedExtensions(req, err)
+
+			// the caller gets an answer, but the delivery itself is not acked.
+			res = newErrorResponse(NewInternalError())
+
+			if err := s.reply(d, res, false); err != nil {
+				return err
+			}
+
+			if !s.autoAck {
+				d.Reject(false)
+			}
+
+			return err
+		}
+
+		return s.reply(d, res, true)
 	} else {
+		message := fmt.Sprintf("Method '%s' not found.", methodName)
+
+		// let the caller fail fast instead of waiting until it times out.
+		if d.ReplyTo != "" {
+			err := s.reply(d, newErrorResponse(NewRPCError(StatusNotFound, ErrorCodeMethodNotFound, message)), false)
+
+			if err != nil {
+				return err
+			}
+		}
+
 		if !s.autoAck {
 			d.Reject(false)
 		}
-		return fmt.Errorf("Method '%s' not found.", methodName)
+
+		return errors.New(message)
+	}
+}
+
+// invoke calls the method handler, recovering from any panic.
+func (s *server) invoke(method MethodHandler, req Request, res Response) (err *PanicError) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+
+	method(req, res)
+
+	return nil
+}
+
+// reply publishes the response to the caller and waits for the broker confirmation.
+// The delivery is acked as well if requested.
+func (s *server) reply(d amqp.Delivery, res Response, ack bool) error {
+	resWriter := s.newResponseWriter(d)
+
+	var err error
+
+	if ack {
+		err = resWriter.Write(res)
+	} else {
+		err = resWriter.publish(res)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error writing response: %s", err)
 	}
 
 	return nil
 }
 
+func (s *server) newResponseWriter(d amqp.Delivery) *responseWriter {
+	deadline, _ := requestDeadline(d)
+
+	return &responseWriter{
+		delivery:    d,
+		deadline:    deadline,
+		publisher:   s.broker,
+		autoAck:     s.autoAck,
+		compression: s.compression,
+		claimCheck:  s.claimCheck,
+	}
+}
+
+// requestDeadline returns when the caller of the given delivery gives up waiting,
+// based on the publish time and the message TTL.
+func requestDeadline(d amqp.Delivery) (time.Time, bool) {
+	if d.Expiration == "" {
+		return time.Time{}, false
+	}
+
+	ttl, err := strconv.ParseInt(d.Expiration, 10, 64)
+
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	publishedAt := d.Timestamp
+
+	if ms, ok := d.Headers["X-Published-At"].(int64); ok {
+		publishedAt = time.Unix(0, ms*int64(time.Millisecond))
+	}
+
+	if publishedAt.IsZero() {
+		return time.Time{}, false
+	}
+
+	return publishedAt.Add(time.Duration(ttl) * time.Millisecond), true
+}
+
 func (s *server) pipeThroughServerListeningExtensions() {
 	for _, ext := range s.extensions {
 		err := ext.ServerListening(s)
@@ -243,8 +603,71 @@ func (s *server) pipeThroughOutgoingExtensions(req Request, res Response, respon
 	}
 }
 
-func (s *server) Register(method string, handler MethodHandler) {
-	s.methods[method] = func(req Request, res Response) {
+func (s *server) pipeThroughFailedExtensions(req Request, err error) {
+	for _, ext := range s.extensions {
+		if failed, ok := ext.(FailureExtension); ok {
+			failed.RequestFailed(req, err)
+		}
+	}
+}
+
+func (s *server) Register(method string, handler MethodHandler, middlewares ...Middleware) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.methods[method] = chain(handler, middlewares)
+}
+
+func (s *server) RegisterWithSpec(method string, handler MethodHandler, spec Spec, middlewares ...Middleware) {
+	s.Register(method, handler, middlewares...)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.specs[method] = spec
+}
+
+func (s *server) RegisterFunc(method string, fn interface{}, middlewares ...Middleware) error {
+	handler, spec, err := NewFuncHandler(fn)
+
+	if err != nil {
+		return err
+	}
+
+	s.RegisterWithSpec(method, handler, spec, middlewares...)
+
+	return nil
+}
+
+func (s *server) RegisterStream(method string, handler StreamHandler, middlewares ...Middleware) {
+	s.Register(method, s.streamHandler(handler), middlewares...)
+}
+
+func (s *server) Use(middlewares ...Middleware) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.middlewares = append(s.middlewares, middlewares...)
+}
+
+// method returns the handler of a registered method, wrapped by the global middlewares.
+func (s *server) method(name string) (MethodHandler, bool) {
+	s.m.Lock()
+	handler, ok := s.methods[name]
+	middlewares := s.middlewares
+	s.m.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	// the middlewares are chained without holding the lock, they may use the server.
+	return chain(handler, middlewares), true
+}
+
+// decorate wraps a method handler with the extensions.
+func (s *server) decorate(handler MethodHandler) MethodHandler {
+	return func(req Request, res Response) {
 		s.pipeThroughIncomingExtensions(req)
 
 		started := time.Now()
@@ -256,11 +679,6 @@ func (s *server) Register(method string, handler MethodHandler) {
 	}
 }
 
-func (s *server) RegisterWithSpec(method string, handler MethodHandler, spec Spec) {
-	s.Register(method, handler)
-	s.specs[method] = spec
-}
-
 // GetServiceName returns the name of this service.
 func (s *server) GetServiceName() string {
 	return s.serviceName
@@ -268,7 +686,16 @@ func (s *server) GetServiceName() string {
 
 // GetSpecs returns all registered specs.
 func (s *server) GetSpecs() map[string]Spec {
-	return s.specs
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	specs := make(map[string]Spec, len(s.specs))
+
+	for method, spec := range s.specs {
+		specs[method] = spec
+	}
+
+	return specs
 }
 
 func (s *server) AddExtension(ext Extension) {
@@ -280,24 +707,122 @@ func (s *server) ListenAndServe() {
 }
 
 func (s *server) Close() {
-	s.closed = true
+	s.m.Lock()
+	s.markClosed()
+	serving := s.serving
 	s.channel.Close()
+	s.closeControl()
+	s.m.Unlock()
+
+	// serve is not running to finish the server.
+	if !serving {
+		s.finish(ErrServerClosed)
+	}
 }
 
-func (s *server) Shutdown() {
-	ch := make(chan bool)
+func (s *server) Shutdown(ctx context.Context) error {
+	s.m.Lock()
+	s.markClosed()
+	serving := s.serving
+	channel := s.channel
+	deliveries := s.requestChannel
+	s.m.Unlock()
+
+	if serving {
+		// stop receiving requests, the ones already delivered are still handled.
+		if err := channel.Cancel(s.consumerTag, false); err != nil && err != amqp.ErrClosed {
+			log.Printf("[PORTHOS] Error cancelling the consumer: %s", err)
+		}
+
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			s.m.Lock()
+			s.abandoned = true
+			s.m.Unlock()
 
-	go func() {
-		ch <- <-s.NotifyClose()
-	}()
+			s.nackPending(deliveries)
+			channel.Close()
+			s.closeControl()
+
+			return ctx.Err()
+		}
+	}
+
+	channel.Close()
+	s.closeControl()
+
+	if !serving {
+		s.finish(ErrServerClosed)
+	}
+
+	return nil
+}
 
-	s.Close()
-	<-ch
+// nackPending requeues the deliveries not taken by any worker yet.
+// The unacked ones left, including those still being handled, are requeued when the channel closes.
+func (s *server) nackPending(deliveries <-chan amqp.Delivery) {
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return
+			}
+
+			if !s.autoAck {
+				d.Nack(false, true)
+			}
+		default:
+			return
+		}
+	}
 }
 
 func (s *server) NotifyClose() <-chan bool {
-	receiver := make(chan bool)
-	s.closes = append(s.closes, receiver)
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	receiver := make(chan bool, 1)
+
+	select {
+	case <-s.done:
+		receiver <- true
+	default:
+		s.closes = append(s.closes, receiver)
+	}
 
 	return receiver
 }
+
+func (s *server) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *server) Err() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.err
+}
+
+// markClosed must be called holding the lock.
+func (s *server) markClosed() {
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+}
+
+func (s *server) isClosed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.closed
+}
+
+func (s *server) isAbandoned() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.abandoned
+}
@@ -1,10 +1,9 @@
 package porthos
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
+
+	"github.com/streadway/amqp"
 )
 
 // Request represents a rpc request.
@@ -15,9 +14,11 @@ type Request interface {
 	GetMethodName() string
 	// GetBody returns the request body.
 	GetBody() []byte
+	// GetHeaders returns the request headers.
+	GetHeaders() *Headers
 	// Form returns a index-based form.
 	Form() (Form, error)
-	// Bind binds the body to an interface.
+	// Bind decodes the body into an interface, using the codec of the request content type.
 	Bind(i interface{}) error
 	// WithContext returns a shallow copy of Event with its context changed to context.
 	// The provided context must be non-nil.
@@ -32,7 +33,10 @@ type request struct {
 	methodName  string
 	contentType string
 	body        []byte
+	headers     *Headers
 	ctx         context.Context
+	// delivery of the request, used to stream the response.
+	delivery amqp.Delivery
 }
 
 func (r *request) GetServiceName() string {
@@ -47,18 +51,20 @@ func (r *request) GetBody() []byte {
 	return r.body
 }
 
+func (r *request) GetHeaders() *Headers {
+	if r.headers == nil {
+		r.headers = NewHeaders()
+	}
+
+	return r.headers
+}
+
 func (r *request) Form() (Form, error) {
 	return NewForm(r.contentType, r.body)
 }
 
 func (r *request) Bind(i interface{}) error {
-	if r.contentType != "application/json" {
-		return fmt.Errorf("Invalid content type, got: %s", r.contentType)
-	}
-
-	decoder := json.NewDecoder(bytes.NewReader(r.body))
-	decoder.UseNumber()
-	return decoder.Decode(i)
+	return Unmarshal(r.contentType, r.body, i)
 }
 
 func (r *request) WithContext(ctx context.Context) Request {
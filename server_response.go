@@ -1,17 +1,28 @@
 package porthos
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 )
 
 // Response represents a rpc response.
 type Response interface {
 	// JSON sets the content of the response as JSON data.
 	JSON(int32, interface{})
+	// Encode sets the content of the response as the given value encoded with the best codec
+	// accepted by the caller (see AcceptHeader). Without an accept list, it is encoded like the request,
+	// or as JSON if there's no codec for it. If the caller accepts no registered codec, the response
+	// is a StatusNotAcceptable error.
+	Encode(int32, interface{})
 	// Raw sets the content of the response as an array of bytes.
 	Raw(int32, string, []byte)
 	// Empty leaves the content of the response as empty.
 	Empty(int32)
+	// Error sets the content of the response as the error envelope of the given error.
+	// An *RPCError (or an error wrapping one) is sent as is, any other error (or nil) as the
+	// generic internal error, see ToRPCError.
+	Error(err error)
 	// GetHeaders returns the response headers.
 	GetHeaders() *Headers
 	// GetStatusCode returns the response status.
@@ -25,28 +36,86 @@ type response struct {
 	contentType string
 	statusCode  int32
 	headers     *Headers
+	// encodeType is the content type preferred by Encode.
+	encodeType string
+	// accept is the accept list of the caller.
+	accept string
 }
 
 func newResponse() Response {
 	return &response{
-		headers: NewHeaders(),
+		headers:    NewHeaders(),
+		encodeType: ContentTypeJSON,
 	}
 }
 
+// newResponseTo creates the response of a request, encoding it like the request.
+func newResponseTo(req *request) Response {
+	res := &response{
+		headers:    NewHeaders(),
+		encodeType: ContentTypeJSON,
+	}
+
+	if _, ok := LookupCodec(req.contentType); ok {
+		res.encodeType = mediaType(req.contentType)
+	}
+
+	res.accept, _ = req.GetHeaders().Get(AcceptHeader).(string)
+
+	return res
+}
+
+func newErrorResponse(err error) Response {
+	res := newResponse()
+	res.Error(err)
+
+	return res
+}
+
 func (r *response) JSON(statusCode int32, body interface{}) {
 	if body == nil {
 		panic("Response body is empty")
 	}
 
-	jsonBody, err := json.Marshal(&body)
+	r.encode(statusCode, ContentTypeJSON, body)
+}
+
+func (r *response) Encode(statusCode int32, body interface{}) {
+	if body == nil {
+		panic("Response body is empty")
+	}
+
+	contentType, err := r.negotiate()
+
+	if err != nil {
+		r.Error(err)
+		return
+	}
+
+	r.encode(statusCode, contentType, body)
+}
+
+// negotiate returns the content type of the best codec accepted by the caller.
+func (r *response) negotiate() (string, error) {
+	contentType, ok := negotiate(r.accept, r.encodeType)
+
+	if !ok {
+		return "", NewRPCError(StatusNotAcceptable, ErrorCodeNotAcceptable, fmt.Sprintf("None of the accepted content types is supported: %s.", r.accept))
+	}
+
+	return contentType, nil
+}
+
+func (r *response) encode(statusCode int32, contentType string, body interface{}) {
+	data, err := Marshal(contentType, body)
 
 	if err != nil {
 		panic(err)
 	}
 
 	r.statusCode = statusCode
-	r.body = jsonBody
-	r.contentType = "application/json"
+	r.body = data
+	r.contentType = contentType
 }
 
 func (r *response) Raw(statusCode int32, contentType string, body []byte) {
@@ -63,6 +132,19 @@ func (r *response) Empty(statusCode int32) {
 	r.statusCode = statusCode
 }
 
+func (r *response) Error(err error) {
+	var rpcErr *RPCError
+
+	// only the server sees the details of an internal error.
+	if !errors.As(err, &rpcErr) {
+		log.Printf("[PORTHOS] Replying internal error: %v", err)
+	}
+
+	rpcErr = ToRPCError(err)
+
+	r.JSON(rpcErr.StatusCode, rpcErr)
+}
+
 func (r *response) GetHeaders() *Headers {
 	return r.headers
 }
@@ -1,6 +1,7 @@
 package porthos
 
 import (
+	"context"
 	"sync"
 )
 
@@ -16,6 +17,8 @@ type Slot interface {
 
 type slot struct {
 	responseChannel chan ClientResponse
+	disposed        chan struct{}
+	onDispose       func()
 	mutex           sync.Mutex
 	id              string
 }
@@ -31,6 +34,9 @@ func (slot *slot) GetCorrelationID() (string, error) {
 }
 
 func (slot *slot) ResponseChannel() <-chan ClientResponse {
+	slot.mutex.Lock()
+	defer slot.mutex.Unlock()
+
 	return slot.responseChannel
 }
 
@@ -40,7 +46,12 @@ func (slot *slot) Dispose() {
 
 	if slot.responseChannel != nil {
 		close(slot.responseChannel)
+		close(slot.disposed)
 		slot.responseChannel = nil
+
+		if slot.onDispose != nil {
+			slot.onDispose()
+		}
 	}
 }
 
@@ -48,13 +59,45 @@ func (slot *slot) sendResponse(c ClientResponse) {
 	slot.mutex.Lock()
 	defer slot.mutex.Unlock()
 
+	// the channel is buffered, a response is never waiting for a reader.
 	if slot.responseChannel != nil {
-		slot.responseChannel <- c
+		select {
+		case slot.responseChannel <- c:
+		default:
+		}
 	}
 }
 
 func NewSlot() *slot {
 	return &slot{
-		responseChannel: make(chan ClientResponse),
+		responseChannel: make(chan ClientResponse, 1),
+		disposed:        make(chan struct{}),
+	}
+}
+
+// disposeWhenDone disposes the slot once the context is done.
+func disposeWhenDone(ctx context.Context, slot *slot) {
+	if ctx.Done() == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			slot.Dispose()
+		case <-slot.disposed:
+		}
+	}()
+}
+
+// chainDispose returns a dispose hook calling both given hooks.
+func chainDispose(first, second func()) func() {
+	if first == nil {
+		return second
+	}
+
+	return func() {
+		first()
+		second()
 	}
 }
@@ -31,5 +31,6 @@ const (
 	StatusInternalServerError         int32 = 500
 	StatusNotImplemented              int32 = 501
 	StatusServiceUnavailable          int32 = 503
+	StatusGatewayTimeout              int32 = 504
 	StatusInsufficientStorage         int32 = 507
 )
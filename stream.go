@@ -0,0 +1,385 @@
+package porthos
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	ErrStreamCanceled   = errors.New("Stream canceled by the caller.")
+	ErrStreamOutOfOrder = errors.New("Stream chunk received out of order.")
+	ErrStreamOverflow   = errors.New("Stream chunks exceed the granted credit.")
+	// ErrStreamControlLost stops the streams whose control queue is gone, e.g. after a reconnection:
+	// their caller can't grant credit anymore.
+	ErrStreamControlLost = errors.New("Stream control queue lost.")
+)
+
+// Headers of the streaming protocol.
+const (
+	// streamWindowHeader is the number of chunks the caller accepts before granting more credit.
+	streamWindowHeader = "X-Stream-Window"
+	// streamSeqHeader is the sequence number of a chunk, starting at zero.
+	// Responses without it end the stream.
+	streamSeqHeader = "X-Stream-Seq"
+	// streamControlHeader is the queue of the server receiving the credits and cancellations of a stream.
+	streamControlHeader = "X-Stream-Control"
+	// streamCreditHeader is the number of chunks granted by a control message.
+	streamCreditHeader = "X-Stream-Credit"
+	// streamCancelHeader marks a control message canceling the stream.
+	streamCancelHeader = "X-Stream-Cancel"
+	// streamEndHeader marks the response ending a stream successfully.
+	streamEndHeader = "X-Stream-End"
+)
+
+// DefaultStreamWindow is the number of chunks a client accepts before granting more credit,
+// when ClientOptions.StreamWindow is not set.
+const DefaultStreamWindow = 16
+
+// ResponseStream sends the chunks of a streaming response.
+type ResponseStream interface {
+	// Send encodes the value like Response.Encode and sends it as the next chunk.
+	// It blocks while the caller has not granted credit for more chunks, and fails with
+	// ErrStreamCanceled once the caller cancels the stream, ErrStreamControlLost if the
+	// control queue is lost (e.g. on reconnection) or with the context error.
+	Send(v interface{}) error
+	// SendRaw sends the body as the next chunk, see Send.
+	SendRaw(contentType string, body []byte) error
+	// Context is done when the caller cancels the stream or its deadline is exceeded.
+	Context() context.Context
+}
+
+// StreamHandler handles a streaming method, sending the chunks through the stream.
+// The stream ends when it returns: successfully if the error is nil, otherwise
+// with the error replied like Response.Error does.
+type StreamHandler func(req Request, stream ResponseStream) error
+
+type responseStream struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	req     *request
+	writer  *responseWriter
+	control string
+	seq     int64
+
+	m       sync.Mutex
+	credit  int
+	stopErr error
+	credits chan struct{}
+}
+
+func (st *responseStream) Send(v interface{}) error {
+	res := newResponseTo(st.req).(*response)
+
+	contentType, err := res.negotiate()
+
+	if err != nil {
+		return err
+	}
+
+	body, err := Marshal(contentType, v)
+
+	if err != nil {
+		return err
+	}
+
+	res.Raw(StatusOK, contentType, body)
+
+	return st.send(res)
+}
+
+func (st *responseStream) SendRaw(contentType string, body []byte) error {
+	res := newResponse()
+	res.Raw(StatusOK, contentType, body)
+
+	return st.send(res)
+}
+
+func (st *responseStream) Context() context.Context {
+	return st.ctx
+}
+
+func (st *responseStream) send(res Response) error {
+	if err := st.acquire(); err != nil {
+		return err
+	}
+
+	res.GetHeaders().Set(streamSeqHeader, st.seq)
+	res.GetHeaders().Set(streamControlHeader, st.control)
+
+	st.seq++
+
+	// a chunk waiting for the broker is abandoned once the stream is canceled.
+	if err := st.writer.publishContext(st.ctx, res); err != nil {
+		if stopErr := st.stopped(); stopErr != nil {
+			return stopErr
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// acquire takes the credit of a chunk, waiting for the caller to grant it.
+func (st *responseStream) acquire() error {
+	for {
+		st.m.Lock()
+
+		if st.stopErr != nil {
+			st.m.Unlock()
+			return st.stopErr
+		}
+
+		if st.credit > 0 {
+			st.credit--
+			st.m.Unlock()
+			return nil
+		}
+
+		st.m.Unlock()
+
+		select {
+		case <-st.credits:
+		case <-st.ctx.Done():
+			if err := st.stopped(); err != nil {
+				return err
+			}
+
+			return st.ctx.Err()
+		}
+	}
+}
+
+// grant gives credit for n more chunks.
+func (st *responseStream) grant(n int) {
+	st.m.Lock()
+	st.credit += n
+	st.m.Unlock()
+
+	select {
+	case st.credits <- struct{}{}:
+	default:
+	}
+}
+
+// stop cancels the stream, Send failing with the error from now on.
+func (st *responseStream) stop(err error) {
+	st.m.Lock()
+
+	if st.stopErr == nil {
+		st.stopErr = err
+	}
+
+	st.m.Unlock()
+
+	st.cancel()
+}
+
+// stopped returns the error the stream was stopped with, if any.
+func (st *responseStream) stopped() error {
+	st.m.Lock()
+	defer st.m.Unlock()
+
+	return st.stopErr
+}
+
+// streamHandler adapts a StreamHandler to a MethodHandler. The response written once the
+// handler returns ends the stream.
+func (s *server) streamHandler(handler StreamHandler) MethodHandler {
+	return func(req Request, res Response) {
+		r, ok := req.(*request)
+
+		if !ok {
+			res.Error(NewRPCError(StatusInternalServerError, ErrorCodeInternal, "Streaming requires the request of the server."))
+			return
+		}
+
+		control, err := s.controlQueueName()
+
+		if err != nil {
+			res.Error(err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		window := DefaultStreamWindow
+
+		if w, ok := r.GetHeaders().Get(streamWindowHeader).(int32); ok && w > 0 {
+			window = int(w)
+		}
+
+		st := &responseStream{
+			ctx:     ctx,
+			cancel:  cancel,
+			req:     r,
+			writer:  s.newResponseWriter(r.delivery),
+			control: control,
+			credit:  window,
+			credits: make(chan struct{}, 1),
+		}
+
+		id := r.delivery.CorrelationId
+
+		s.streamsLock.Lock()
+		s.streams[id] = st
+		// the control queue may be lost meanwhile, see handleControl.
+		stale := s.controlQueue != control
+		s.streamsLock.Unlock()
+
+		if stale {
+			st.stop(ErrStreamControlLost)
+		}
+
+		defer func() {
+			s.streamsLock.Lock()
+			delete(s.streams, id)
+			s.streamsLock.Unlock()
+		}()
+
+		if err := handler(req.WithContext(ctx), st); err != nil {
+			res.Error(err)
+			return
+		}
+
+		res.GetHeaders().Set(streamEndHeader, true)
+		res.Empty(StatusOK)
+	}
+}
+
+// controlQueueName returns the queue receiving the control messages of the streams,
+// declaring it on first use. Concurrent streams wait for the same declaration.
+func (s *server) controlQueueName() (string, error) {
+	s.streamsLock.Lock()
+
+	for s.controlQueue == "" && s.controlDeclared != nil {
+		declared := s.controlDeclared
+		s.streamsLock.Unlock()
+
+		<-declared
+
+		s.streamsLock.Lock()
+	}
+
+	if s.controlQueue != "" {
+		defer s.streamsLock.Unlock()
+		return s.controlQueue, nil
+	}
+
+	declared := make(chan struct{})
+	s.controlDeclared = declared
+	s.streamsLock.Unlock()
+
+	// declared without holding the lock, the control messages of the running streams are still handled.
+	ch, q, dc, err := s.declareControl()
+
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+
+	s.controlDeclared = nil
+	close(declared)
+
+	if err != nil {
+		return "", err
+	}
+
+	s.controlChannel = ch
+	s.controlQueue = q
+
+	go s.handleControl(ch, q, dc)
+
+	return q, nil
+}
+
+// declareControl declares the control queue on its own channel and starts consuming it.
+func (s *server) declareControl() (Channel, string, <-chan amqp.Delivery, error) {
+	ch, err := s.broker.openChannel()
+
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when usused
+		true,  // exclusive
+		false, // noWait
+		nil,   // arguments
+	)
+
+	if err != nil {
+		ch.Close()
+		return nil, "", nil, err
+	}
+
+	dc, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		true,   // auto-ack
+		true,   // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+
+	if err != nil {
+		ch.Close()
+		return nil, "", nil, err
+	}
+
+	return ch, q.Name, dc, nil
+}
+
+// handleControl applies the control messages to the streams, until the channel closes.
+// The streams of the queue are stopped then, as their caller can't grant credit anymore.
+func (s *server) handleControl(ch Channel, queue string, dc <-chan amqp.Delivery) {
+	for d := range dc {
+		s.streamsLock.Lock()
+		st := s.streams[d.CorrelationId]
+		s.streamsLock.Unlock()
+
+		if st == nil {
+			continue
+		}
+
+		if _, ok := d.Headers[streamCancelHeader]; ok {
+			st.stop(ErrStreamCanceled)
+		} else if credit, ok := d.Headers[streamCreditHeader].(int32); ok {
+			st.grant(int(credit))
+		}
+	}
+
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+
+	// the next stream declares a new one.
+	if s.controlChannel == ch {
+		s.controlChannel = nil
+		s.controlQueue = ""
+	}
+
+	for _, st := range s.streams {
+		if st.control == queue {
+			st.stop(ErrStreamControlLost)
+		}
+	}
+}
+
+// closeControl closes the channel of the control queue, if any.
+func (s *server) closeControl() {
+	s.streamsLock.Lock()
+	ch := s.controlChannel
+	s.streamsLock.Unlock()
+
+	if ch != nil {
+		if err := ch.Close(); err != nil && err != amqp.ErrClosed {
+			log.Printf("[PORTHOS] Error closing the stream control channel: %s", err)
+		}
+	}
+}
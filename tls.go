@@ -0,0 +1,70 @@
+package porthos
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	// ErrInvalidCAFile returned when the CA file does not contain any PEM certificate.
+	ErrInvalidCAFile = errors.New("No certificate found in the CA file.")
+)
+
+// TLSConfig holds the TLS settings of amqps connections.
+type TLSConfig struct {
+	// CAFile is a PEM file with the authorities trusted to verify the server certificate.
+	// The system pool is used if empty.
+	CAFile string
+	// CertFile and KeyFile are the PEM files of the client certificate, required by mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName is verified against the server certificate, defaults to the host of the url.
+	ServerName string
+}
+
+// ExternalAuth is the SASL EXTERNAL mechanism: the broker authenticates the client
+// by its TLS certificate instead of a username and password.
+type ExternalAuth struct{}
+
+// Mechanism implements amqp.Authentication.
+func (ExternalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+// Response implements amqp.Authentication.
+func (ExternalAuth) Response() string {
+	return ""
+}
+
+// build loads the certificates, it is called on every dial so renewed files are picked up.
+func (c *TLSConfig) build() (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.ServerName}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCAFile
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,104 @@
+package porthos
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCertificate writes a self-signed certificate and its key as PEM files.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "porthos"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestTLSConfigBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "porthos")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir)
+
+	config, err := (&TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "rabbit"}).build()
+
+	if assert.Nil(t, err) {
+		assert.Equal(t, "rabbit", config.ServerName)
+		assert.NotNil(t, config.RootCAs)
+		assert.Len(t, config.Certificates, 1)
+	}
+
+	_, err = (&TLSConfig{CAFile: keyFile}).build()
+	assert.Equal(t, ErrInvalidCAFile, err)
+
+	_, err = (&TLSConfig{CertFile: certFile}).build()
+	assert.NotNil(t, err, "The client certificate requires its key.")
+}
+
+func TestNewAMQPConfig(t *testing.T) {
+	config, err := newAMQPConfig(Config{
+		TLS:            &TLSConfig{ServerName: "rabbit"},
+		SASL:           []amqp.Authentication{ExternalAuth{}},
+		Heartbeat:      5 * time.Second,
+		Vhost:          "/production",
+		ConnectionName: "orders",
+	})
+
+	if assert.Nil(t, err) {
+		assert.Equal(t, "rabbit", config.TLSClientConfig.ServerName)
+		assert.Equal(t, "EXTERNAL", config.SASL[0].Mechanism())
+		assert.Equal(t, 5*time.Second, config.Heartbeat)
+		assert.Equal(t, "/production", config.Vhost)
+		assert.Equal(t, "orders", config.Properties["connection_name"])
+	}
+
+	_, err = newAMQPConfig(Config{TLS: &TLSConfig{CAFile: "missing.pem"}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,121 @@
+package porthos
+
+import (
+	"net"
+
+	"github.com/streadway/amqp"
+)
+
+// Transport dials connections to a message broker.
+// The default transport talks AMQP to a RabbitMQ server, see NewAMQPTransport.
+// NewMemoryTransport provides an in-process implementation for tests.
+type Transport interface {
+	// Dial opens a new connection to the given broker url.
+	Dial(url string, config Config) (Connection, error)
+}
+
+// Connection represents a connection to the broker.
+type Connection interface {
+	// Channel opens a new channel on the connection.
+	Channel() (Channel, error)
+	// NotifyClose registers a listener for when the connection closes.
+	// The receiver gets an *amqp.Error if the connection was closed by an error and
+	// it is closed right after, or immediately if the connection is already closed.
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	// NotifyBlocked registers a listener for when the broker blocks or unblocks the
+	// publishes of the connection (flow control). The receiver is closed with the connection.
+	NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking
+	// Close the connection and all its channels.
+	Close() error
+}
+
+// Channel represents a channel opened on a Connection.
+// Deliveries are acked or rejected through their own Acknowledger.
+type Channel interface {
+	// QueueDeclare declares a queue, creating it if it does not exist yet.
+	// An empty name lets the broker generate one.
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	// Qos controls how many unacked messages the broker delivers to each consumer of the channel.
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	// Consume starts delivering messages from the given queue.
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	// Cancel stops the deliveries of a consumer. The deliveries already sent are still received
+	// before the delivery channel is closed, and they remain unacked.
+	Cancel(consumer string, noWait bool) error
+	// Publish sends a message to an exchange.
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	// Confirm puts the channel into confirm mode.
+	Confirm(noWait bool) error
+	// NotifyPublish registers a listener for publisher confirms.
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	// Close the channel.
+	Close() error
+}
+
+type amqpTransport struct{}
+
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+// NewAMQPTransport creates a transport that dials a RabbitMQ server.
+func NewAMQPTransport() Transport {
+	return &amqpTransport{}
+}
+
+func (t *amqpTransport) Dial(url string, config Config) (Connection, error) {
+	amqpConfig, err := newAMQPConfig(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := amqp.DialConfig(url, amqpConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &amqpConnection{conn}, nil
+}
+
+// newAMQPConfig translates the broker config, it is called on every dial.
+func newAMQPConfig(config Config) (amqp.Config, error) {
+	amqpConfig := amqp.Config{
+		SASL:      config.SASL,
+		Vhost:     config.Vhost,
+		Heartbeat: config.Heartbeat,
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, config.DialTimeout)
+		},
+	}
+
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.build()
+
+		if err != nil {
+			return amqp.Config{}, err
+		}
+
+		amqpConfig.TLSClientConfig = tlsConfig
+	}
+
+	if config.ConnectionName != "" {
+		amqpConfig.Properties = amqp.Table{
+			"product":         "porthos",
+			"connection_name": config.ConnectionName,
+		}
+	}
+
+	return amqpConfig, nil
+}
+
+func (c *amqpConnection) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
@@ -0,0 +1,897 @@
+package porthos
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrMemoryExchange returned when publishing to an exchange other than the default one.
+	ErrMemoryExchange = errors.New("Memory transport only supports the default exchange.")
+)
+
+// MemoryTransport is an in-process Transport.
+// It implements the subset of AMQP used by porthos (default exchange, queues, consumers,
+// prefetch, acks, rejects, publisher confirms and direct reply-to), so clients and servers can be tested
+// without a broker.
+type MemoryTransport struct {
+	m       sync.Mutex
+	queues  map[string]*memoryQueue
+	conns   map[*memoryConnection]bool
+	dialErr error
+	blocked *amqp.Blocking
+	seq     int
+}
+
+type memoryConnection struct {
+	transport *MemoryTransport
+	channels  map[*memoryChannel]bool
+	closes    []chan *amqp.Error
+	blocks    []*memoryBlockedListener
+	closed    bool
+}
+
+// memoryBlockedListener delivers the blocked notifications of a connection in order.
+type memoryBlockedListener struct {
+	receiver chan amqp.Blocking
+	queue    []amqp.Blocking
+	cond     *sync.Cond
+	closed   bool
+}
+
+type memoryChannel struct {
+	conn         *memoryConnection
+	consumers    map[string]*memoryConsumer
+	unacked      map[uint64]*memoryUnacked
+	deliveryTag  uint64
+	prefetch     int
+	confirming   bool
+	publishSeq   uint64
+	confirmQueue []amqp.Confirmation
+	confirmCond  *sync.Cond
+	confirms     []chan amqp.Confirmation
+	replyTo      string
+	closed       bool
+}
+
+type memoryQueue struct {
+	name       string
+	autoDelete bool
+	exclusive  bool
+	owner      *memoryConnection
+	messages   []*memoryMessage
+	consumers  []*memoryConsumer
+	next       int
+}
+
+type memoryMessage struct {
+	publishing  amqp.Publishing
+	routingKey  string
+	expires     time.Time
+	redelivered bool
+}
+
+type memoryUnacked struct {
+	queue    *memoryQueue
+	consumer *memoryConsumer
+	message  *memoryMessage
+}
+
+type memoryConsumer struct {
+	tag       string
+	queue     *memoryQueue
+	channel   *memoryChannel
+	autoAck   bool
+	prefetch  int
+	unacked   int
+	pending   []amqp.Delivery
+	cond      *sync.Cond
+	out       chan amqp.Delivery
+	stop      chan struct{}
+	cancelled bool
+	stopped   bool
+}
+
+// NewMemoryTransport creates an empty in-process broker.
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		queues: make(map[string]*memoryQueue),
+		conns:  make(map[*memoryConnection]bool),
+	}
+}
+
+// Dial opens a new in-process connection. The url is ignored.
+func (t *MemoryTransport) Dial(url string, config Config) (Connection, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.dialErr != nil {
+		return nil, t.dialErr
+	}
+
+	c := &memoryConnection{
+		transport: t,
+		channels:  make(map[*memoryChannel]bool),
+	}
+
+	t.conns[c] = true
+
+	return c, nil
+}
+
+// SetDialError makes every following Dial fail with the given error.
+// Pass nil to accept connections again.
+func (t *MemoryTransport) SetDialError(err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.dialErr = err
+}
+
+// Disconnect drops all open connections as if the broker went away.
+func (t *MemoryTransport) Disconnect() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for c := range t.conns {
+		c.shutdown(&amqp.Error{
+			Code:   amqp.ConnectionForced,
+			Reason: "connection dropped by the memory transport",
+			Server: true,
+		})
+	}
+}
+
+// Block blocks the publishes of all connections, as RabbitMQ does when an alarm is raised.
+// Publishes are still accepted by the memory transport, only the notifications are sent.
+func (t *MemoryTransport) Block(reason string) {
+	t.setBlocked(amqp.Blocking{Active: true, Reason: reason})
+}
+
+// Unblock ends the blocking started by Block.
+func (t *MemoryTransport) Unblock() {
+	t.setBlocked(amqp.Blocking{Active: false})
+}
+
+func (t *MemoryTransport) setBlocked(b amqp.Blocking) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if b.Active {
+		t.blocked = &b
+	} else {
+		t.blocked = nil
+	}
+
+	for c := range t.conns {
+		for _, l := range c.blocks {
+			l.push(b)
+		}
+	}
+}
+
+func (t *MemoryTransport) nextName(prefix string) string {
+	t.seq++
+	return fmt.Sprintf("%s-%d", prefix, t.seq)
+}
+
+func (t *MemoryTransport) deleteQueue(q *memoryQueue) {
+	delete(t.queues, q.name)
+
+	for _, c := range q.consumers {
+		delete(c.channel.consumers, c.tag)
+		c.cancel()
+	}
+
+	q.consumers = nil
+	q.messages = nil
+}
+
+func (c *memoryConnection) Channel() (Channel, error) {
+	t := c.transport
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	ch := &memoryChannel{
+		conn:      c,
+		consumers: make(map[string]*memoryConsumer),
+		unacked:   make(map[uint64]*memoryUnacked),
+	}
+	ch.confirmCond = sync.NewCond(&t.m)
+
+	c.channels[ch] = true
+
+	return ch, nil
+}
+
+func (c *memoryConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	t := c.transport
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if c.closed {
+		close(receiver)
+	} else {
+		c.closes = append(c.closes, receiver)
+	}
+
+	return receiver
+}
+
+func (c *memoryConnection) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	t := c.transport
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+
+	l := &memoryBlockedListener{receiver: receiver, cond: sync.NewCond(&t.m)}
+
+	c.blocks = append(c.blocks, l)
+
+	if t.blocked != nil {
+		l.push(*t.blocked)
+	}
+
+	go l.run()
+
+	return receiver
+}
+
+func (c *memoryConnection) Close() error {
+	t := c.transport
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+
+	c.shutdown(nil)
+
+	return nil
+}
+
+func (c *memoryConnection) shutdown(err *amqp.Error) {
+	t := c.transport
+
+	if c.closed {
+		return
+	}
+
+	c.closed = true
+
+	for ch := range c.channels {
+		ch.shutdown()
+	}
+
+	for _, q := range t.queues {
+		if q.exclusive && q.owner == c {
+			t.deleteQueue(q)
+		}
+	}
+
+	delete(t.conns, c)
+
+	notifyClose(c.closes, err)
+	c.closes = nil
+
+	for _, l := range c.blocks {
+		l.closed = true
+		l.cond.Signal()
+	}
+
+	c.blocks = nil
+}
+
+func (ch *memoryChannel) transport() *MemoryTransport {
+	return ch.conn.transport
+}
+
+func (ch *memoryChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	t := ch.transport()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	if name == "" {
+		name = t.nextName("amq.gen")
+	}
+
+	q, ok := t.queues[name]
+
+	if ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, &amqp.Error{
+				Code:   amqp.ResourceLocked,
+				Reason: fmt.Sprintf("cannot obtain exclusive access to locked queue '%s'", name),
+			}
+		}
+	} else {
+		q = &memoryQueue{
+			name:       name,
+			autoDelete: autoDelete,
+			exclusive:  exclusive,
+			owner:      ch.conn,
+		}
+
+		t.queues[name] = q
+	}
+
+	return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+}
+
+// Qos sets the prefetch count of the consumers started afterwards on this channel.
+// The prefetch size and the global flag are ignored.
+func (ch *memoryChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	t := ch.transport()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ch.prefetch = prefetchCount
+
+	return nil
+}
+
+func (ch *memoryChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	t := ch.transport()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	if queue == directReplyToQueue {
+		q, err := ch.declareReplyTo(autoAck)
+
+		if err != nil {
+			return nil, err
+		}
+
+		queue = q.name
+	}
+
+	q, ok := t.queues[queue]
+
+	if !ok {
+		return nil, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("no queue '%s'", queue)}
+	}
+
+	if consumer == "" {
+		consumer = t.nextName("ctag")
+	}
+
+	c := &memoryConsumer{
+		tag:      consumer,
+		queue:    q,
+		channel:  ch,
+		autoAck:  autoAck,
+		prefetch: ch.prefetch,
+		cond:     sync.NewCond(&t.m),
+		out:      make(chan amqp.Delivery),
+		stop:     make(chan struct{}),
+	}
+
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+
+	go c.run()
+
+	q.dispatch()
+
+	return c.out, nil
+}
+
+func (ch *memoryChannel) Cancel(consumer string, noWait bool) error {
+	t := ch.transport()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	c, ok := ch.consumers[consumer]
+
+	if !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("no consumer '%s'", consumer)}
+	}
+
+	delete(ch.consumers, consumer)
+	c.queue.removeConsumer(c)
+	c.cancel()
+
+	return nil
+}
+
+func (ch *memoryChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	t := ch.transport()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if exchange != "" {
+		return ErrMemoryExchange
+	}
+
+	m := &memoryMessage{publishing: msg, routingKey: key}
+
+	if msg.Expiration != "" {
+		ttl, err := strconv.ParseInt(msg.Expiration, 10, 64)
+
+		if err != nil || ttl < 0 {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("invalid expiration '%s'", msg.Expiration)}
+		}
+
+		m.expires = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+
+	// the broker owns its copy of the message.
+	if msg.Headers != nil {
+		m.publishing.Headers = make(amqp.Table, len(msg.Headers))
+
+		for k, v := range msg.Headers {
+			m.publishing.Headers[k] = v
+		}
+	}
+
+	m.publishing.Body = append([]byte(nil), msg.Body...)
+
+	if msg.ReplyTo == directReplyToQueue {
+		if ch.replyTo == "" {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: "fast reply consumer does not exist"}
+		}
+
+		m.publishing.ReplyTo = ch.replyTo
+	}
+
+	if q, ok := t.queues[key]; ok {
+		q.messages = append(q.messages, m)
+		q.dispatch()
+	}
+
+	if ch.confirming {
+		ch.publishSeq++
+		ch.confirmQueue = append(ch.confirmQueue, amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: true})
+		ch.confirmCond.Signal()
+	}
+
+	return nil
+}
+
+// declareReplyTo creates the queue behind the direct reply-to pseudo-queue of this channel.
+// As in RabbitMQ, it must be consumed in auto-ack mode.
+func (ch *memoryChannel) declareReplyTo(autoAck bool) (*memoryQueue, error) {
+	t := ch.transport()
+
+	if !autoAck {
+		return nil, &amqp.Error{Code: amqp.PreconditionFailed, Reason: "reply consumer cannot acknowledge"}
+	}
+
+	if ch.replyTo != "" {
+		return nil, &amqp.Error{Code: amqp.PreconditionFailed, Reason: "reply consumer already set"}
+	}
+
+	q := &memoryQueue{
+		name:       t.nextName(directReplyToQueue),
+		autoDelete: true,
+		exclusive:  true,
+		owner:      ch.conn,
+	}
+
+	t.queues[q.name] = q
+	ch.replyTo = q.name
+
+	return q, nil
+}
+
+func (ch *memoryChannel) Confirm(noWait bool) error {
+	t := ch.transport()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if !ch.confirming {
+		ch.confirming = true
+		go ch.runConfirms()
+	}
+
+	return nil
+}
+
+func (ch *memoryChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	t := ch.transport()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if ch.closed {
+		close(confirm)
+	} else {
+		ch.confirms = append(ch.confirms, confirm)
+	}
+
+	return confirm
+}
+
+func (ch *memoryChannel) Close() error {
+	t := ch.transport()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ch.shutdown()
+
+	return nil
+}
+
+// Ack implements amqp.Acknowledger for the deliveries of this channel.
+func (ch *memoryChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, false)
+}
+
+// Nack implements amqp.Acknowledger for the deliveries of this channel.
+func (ch *memoryChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ch.settle(tag, multiple, requeue)
+}
+
+// Reject implements amqp.Acknowledger for the deliveries of this channel.
+func (ch *memoryChannel) Reject(tag uint64, requeue bool) error {
+	return ch.settle(tag, false, requeue)
+}
+
+func (ch *memoryChannel) settle(tag uint64, multiple, requeue bool) error {
+	t := ch.transport()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	var tags []uint64
+
+	if multiple {
+		for unackedTag := range ch.unacked {
+			if unackedTag <= tag {
+				tags = append(tags, unackedTag)
+			}
+		}
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = append(tags, tag)
+	}
+
+	if len(tags) == 0 {
+		return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("unknown delivery tag %d", tag)}
+	}
+
+	ch.release(tags, requeue)
+
+	return nil
+}
+
+// release removes the given deliveries from the unacked set, putting them back to their queues if requested.
+func (ch *memoryChannel) release(tags []uint64, requeue bool) {
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	requeued := make(map[*memoryQueue][]*memoryMessage)
+
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		u.consumer.unacked--
+		delete(ch.unacked, tag)
+
+		if requeue {
+			u.message.redelivered = true
+			requeued[u.queue] = append(requeued[u.queue], u.message)
+		}
+	}
+
+	t := ch.transport()
+
+	for q, messages := range requeued {
+		if t.queues[q.name] == q {
+			q.messages = append(messages, q.messages...)
+		}
+	}
+
+	for _, q := range t.queues {
+		q.dispatch()
+	}
+}
+
+func (ch *memoryChannel) shutdown() {
+	if ch.closed {
+		return
+	}
+
+	ch.closed = true
+
+	for _, c := range ch.consumers {
+		c.queue.removeConsumer(c)
+		c.halt()
+	}
+
+	ch.consumers = nil
+
+	tags := make([]uint64, 0, len(ch.unacked))
+
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+
+	ch.release(tags, true)
+
+	if ch.confirming {
+		ch.confirmCond.Signal()
+	} else {
+		for _, c := range ch.confirms {
+			close(c)
+		}
+
+		ch.confirms = nil
+	}
+
+	delete(ch.conn.channels, ch)
+}
+
+// runConfirms delivers publisher confirms to the listeners in order.
+func (ch *memoryChannel) runConfirms() {
+	t := ch.transport()
+
+	for {
+		t.m.Lock()
+
+		for len(ch.confirmQueue) == 0 && !ch.closed {
+			ch.confirmCond.Wait()
+		}
+
+		if len(ch.confirmQueue) == 0 {
+			listeners := ch.confirms
+			ch.confirms = nil
+			t.m.Unlock()
+
+			for _, l := range listeners {
+				close(l)
+			}
+
+			return
+		}
+
+		confirmation := ch.confirmQueue[0]
+		ch.confirmQueue = ch.confirmQueue[1:]
+		listeners := append([]chan amqp.Confirmation(nil), ch.confirms...)
+
+		t.m.Unlock()
+
+		for _, l := range listeners {
+			l <- confirmation
+		}
+	}
+}
+
+// dispatch hands the ready messages to the consumers in a round-robin fashion.
+func (q *memoryQueue) dispatch() {
+	now := time.Now()
+
+	for len(q.messages) > 0 {
+		m := q.messages[0]
+
+		if !m.expires.IsZero() && !now.Before(m.expires) {
+			q.messages = q.messages[1:]
+			continue
+		}
+
+		c := q.nextConsumer()
+
+		if c == nil {
+			return
+		}
+
+		q.messages = q.messages[1:]
+		c.deliver(m)
+	}
+}
+
+func (q *memoryQueue) nextConsumer() *memoryConsumer {
+	for i := range q.consumers {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+
+		if c.ready() {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (q *memoryQueue) removeConsumer(c *memoryConsumer) {
+	for i, qc := range q.consumers {
+		if qc == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+
+	if q.autoDelete && len(q.consumers) == 0 {
+		c.channel.transport().deleteQueue(q)
+	}
+}
+
+func (c *memoryConsumer) ready() bool {
+	return !c.cancelled && (c.autoAck || c.prefetch <= 0 || c.unacked < c.prefetch)
+}
+
+func (c *memoryConsumer) deliver(m *memoryMessage) {
+	ch := c.channel
+	ch.deliveryTag++
+
+	p := m.publishing
+
+	c.pending = append(c.pending, amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         p.Headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		ConsumerTag:     c.tag,
+		DeliveryTag:     ch.deliveryTag,
+		Redelivered:     m.redelivered,
+		RoutingKey:      m.routingKey,
+		Body:            p.Body,
+	})
+
+	if !c.autoAck {
+		c.unacked++
+		ch.unacked[ch.deliveryTag] = &memoryUnacked{queue: c.queue, consumer: c, message: m}
+	}
+
+	c.cond.Signal()
+}
+
+// cancel stops receiving new messages, the pending ones are still delivered.
+func (c *memoryConsumer) cancel() {
+	c.cancelled = true
+	c.cond.Signal()
+}
+
+// halt stops the consumer right away.
+func (c *memoryConsumer) halt() {
+	if !c.stopped {
+		c.cancelled = true
+		c.stopped = true
+		close(c.stop)
+		c.cond.Signal()
+	}
+}
+
+func (c *memoryConsumer) run() {
+	t := c.channel.transport()
+
+	defer close(c.out)
+
+	for {
+		t.m.Lock()
+
+		for len(c.pending) == 0 && !c.cancelled {
+			c.cond.Wait()
+		}
+
+		if c.stopped || len(c.pending) == 0 {
+			t.m.Unlock()
+			return
+		}
+
+		d := c.pending[0]
+		c.pending = c.pending[1:]
+
+		t.m.Unlock()
+
+		select {
+		case c.out <- d:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (l *memoryBlockedListener) push(b amqp.Blocking) {
+	l.queue = append(l.queue, b)
+	l.cond.Signal()
+}
+
+func (l *memoryBlockedListener) run() {
+	m := l.cond.L
+
+	defer close(l.receiver)
+
+	for {
+		m.Lock()
+
+		for len(l.queue) == 0 && !l.closed {
+			l.cond.Wait()
+		}
+
+		if len(l.queue) == 0 {
+			m.Unlock()
+			return
+		}
+
+		b := l.queue[0]
+		l.queue = l.queue[1:]
+
+		m.Unlock()
+
+		l.receiver <- b
+	}
+}
+
+// notifyClose sends the error to the receivers and closes them. Like amqp, the send blocks until
+// each receiver reads it, so unbuffered receivers don't miss it. It happens in background, out of the transport lock.
+func notifyClose(receivers []chan *amqp.Error, err *amqp.Error) {
+	if len(receivers) == 0 {
+		return
+	}
+
+	go func() {
+		for _, c := range receivers {
+			if err != nil {
+				c <- err
+			}
+
+			close(c)
+		}
+	}()
+}
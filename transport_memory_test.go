@@ -0,0 +1,272 @@
+package porthos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func openMemoryChannel(t *testing.T, transport *MemoryTransport) Channel {
+	conn, err := transport.Dial("memory://", Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ch
+}
+
+func receiveDelivery(t *testing.T, dc <-chan amqp.Delivery) amqp.Delivery {
+	select {
+	case d, ok := <-dc:
+		if !ok {
+			t.Fatal("Delivery channel closed.")
+		}
+
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("No delivery received. Timedout.")
+	}
+
+	return amqp.Delivery{}
+}
+
+func TestMemoryTransportPublishConsume(t *testing.T) {
+	ch := openMemoryChannel(t, NewMemoryTransport())
+
+	q, err := ch.QueueDeclare("", false, false, true, false, nil)
+
+	if assert.Nil(t, err) {
+		assert.NotEmpty(t, q.Name)
+
+		dc, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+		assert.Nil(t, err)
+
+		err = ch.Publish("", q.Name, false, false, amqp.Publishing{
+			Headers:       amqp.Table{"X-Method": "method"},
+			CorrelationId: "correlationId",
+			Body:          []byte("body"),
+		})
+		assert.Nil(t, err)
+
+		d := receiveDelivery(t, dc)
+
+		assert.Equal(t, "method", d.Headers["X-Method"])
+		assert.Equal(t, "correlationId", d.CorrelationId)
+		assert.Equal(t, "body", string(d.Body))
+		assert.Nil(t, d.Ack(false))
+		assert.NotNil(t, d.Ack(false), "Acking twice must fail.")
+	}
+}
+
+func TestMemoryTransportRejectRequeue(t *testing.T) {
+	ch := openMemoryChannel(t, NewMemoryTransport())
+
+	ch.QueueDeclare("test", false, false, false, false, nil)
+	dc, _ := ch.Consume("test", "", false, false, false, false, nil)
+
+	ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte("body")})
+
+	d := receiveDelivery(t, dc)
+	assert.False(t, d.Redelivered)
+	assert.Nil(t, d.Reject(true))
+
+	d = receiveDelivery(t, dc)
+	assert.True(t, d.Redelivered)
+	assert.Equal(t, "body", string(d.Body))
+}
+
+func TestMemoryTransportRedeliverOnChannelClose(t *testing.T) {
+	transport := NewMemoryTransport()
+	ch := openMemoryChannel(t, transport)
+
+	ch.QueueDeclare("test", true, false, false, false, nil)
+	dc, _ := ch.Consume("test", "", false, false, false, false, nil)
+
+	ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte("body")})
+	receiveDelivery(t, dc)
+
+	ch.Close()
+
+	_, ok := <-dc
+	assert.False(t, ok, "Delivery channel must be closed with the channel.")
+
+	ch = openMemoryChannel(t, transport)
+	dc, _ = ch.Consume("test", "", false, false, false, false, nil)
+
+	d := receiveDelivery(t, dc)
+	assert.True(t, d.Redelivered)
+}
+
+func TestMemoryTransportExpiration(t *testing.T) {
+	ch := openMemoryChannel(t, NewMemoryTransport())
+
+	ch.QueueDeclare("test", false, false, false, false, nil)
+
+	ch.Publish("", "test", false, false, amqp.Publishing{Expiration: "10", Body: []byte("expired")})
+	ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte("alive")})
+
+	time.Sleep(20 * time.Millisecond)
+
+	dc, _ := ch.Consume("test", "", true, false, false, false, nil)
+
+	d := receiveDelivery(t, dc)
+	assert.Equal(t, "alive", string(d.Body))
+}
+
+func TestMemoryTransportConfirms(t *testing.T) {
+	ch := openMemoryChannel(t, NewMemoryTransport())
+
+	assert.Nil(t, ch.Confirm(false))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+
+	ch.Publish("", "unroutable", false, false, amqp.Publishing{})
+	ch.Publish("", "unroutable", false, false, amqp.Publishing{})
+
+	assert.Equal(t, amqp.Confirmation{DeliveryTag: 1, Ack: true}, <-confirms)
+	assert.Equal(t, amqp.Confirmation{DeliveryTag: 2, Ack: true}, <-confirms)
+
+	ch.Close()
+
+	_, ok := <-confirms
+	assert.False(t, ok, "Confirms channel must be closed with the channel.")
+}
+
+func TestMemoryTransportDisconnect(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	conn, _ := transport.Dial("memory://", Config{})
+	closes := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch, _ := conn.Channel()
+	ch.QueueDeclare("exclusive", false, false, true, false, nil)
+
+	transport.Disconnect()
+
+	closeErr := <-closes
+	if assert.NotNil(t, closeErr) {
+		assert.Equal(t, amqp.ConnectionForced, closeErr.Code)
+	}
+
+	_, err := conn.Channel()
+	assert.Equal(t, amqp.ErrClosed, err)
+
+	transport.SetDialError(ErrBrokerNotConnected)
+
+	_, err = transport.Dial("memory://", Config{})
+	assert.Equal(t, ErrBrokerNotConnected, err)
+
+	transport.SetDialError(nil)
+
+	ch = openMemoryChannel(t, transport)
+	_, err = ch.Consume("exclusive", "", true, false, false, false, nil)
+	assert.NotNil(t, err, "Exclusive queue must be deleted with its connection.")
+}
+
+func TestMemoryTransportDisconnectUnbufferedReceiver(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	conn, _ := transport.Dial("memory://", Config{})
+	closes := conn.NotifyClose(make(chan *amqp.Error))
+
+	transport.Disconnect()
+
+	// the receiver is not ready when the connection closes, the error must not be lost.
+	time.Sleep(10 * time.Millisecond)
+
+	closeErr := <-closes
+	if assert.NotNil(t, closeErr) {
+		assert.Equal(t, amqp.ConnectionForced, closeErr.Code)
+	}
+
+	_, ok := <-closes
+	assert.False(t, ok)
+}
+
+func TestMemoryTransportPrefetch(t *testing.T) {
+	ch := openMemoryChannel(t, NewMemoryTransport())
+
+	ch.QueueDeclare("test", false, false, false, false, nil)
+	assert.Nil(t, ch.Qos(1, 0, false))
+
+	dc, _ := ch.Consume("test", "", false, false, false, false, nil)
+
+	ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte("first")})
+	ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte("second")})
+
+	d := receiveDelivery(t, dc)
+	assert.Equal(t, "first", string(d.Body))
+
+	select {
+	case <-dc:
+		t.Error("Only one unacked message must be delivered.")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	d.Ack(false)
+
+	d = receiveDelivery(t, dc)
+	assert.Equal(t, "second", string(d.Body))
+}
+
+func TestMemoryTransportDirectReplyTo(t *testing.T) {
+	transport := NewMemoryTransport()
+	ch := openMemoryChannel(t, transport)
+
+	_, err := ch.Consume(directReplyToQueue, "", false, false, false, false, nil)
+	assert.NotNil(t, err, "Direct reply-to must be consumed in auto-ack mode.")
+
+	ch = openMemoryChannel(t, transport)
+
+	err = ch.Publish("", "test", false, false, amqp.Publishing{ReplyTo: directReplyToQueue})
+	assert.NotNil(t, err, "Publishing requires a direct reply-to consumer.")
+
+	ch = openMemoryChannel(t, transport)
+	replies, err := ch.Consume(directReplyToQueue, "", true, false, false, false, nil)
+	assert.Nil(t, err)
+
+	server := openMemoryChannel(t, transport)
+	server.QueueDeclare("test", false, false, false, false, nil)
+	requests, _ := server.Consume("test", "", true, false, false, false, nil)
+
+	ch.Publish("", "test", false, false, amqp.Publishing{ReplyTo: directReplyToQueue, Body: []byte("request")})
+
+	d := receiveDelivery(t, requests)
+	assert.NotEqual(t, directReplyToQueue, d.ReplyTo)
+
+	server.Publish("", d.ReplyTo, false, false, amqp.Publishing{Body: []byte("response")})
+
+	d = receiveDelivery(t, replies)
+	assert.Equal(t, "response", string(d.Body))
+}
+
+func TestMemoryTransportCancel(t *testing.T) {
+	ch := openMemoryChannel(t, NewMemoryTransport())
+
+	ch.QueueDeclare("test", false, false, false, false, nil)
+	dc, _ := ch.Consume("test", "consumer", false, false, false, false, nil)
+
+	ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte("first")})
+	d := receiveDelivery(t, dc)
+
+	assert.Nil(t, ch.Cancel("consumer", false))
+	assert.NotNil(t, ch.Cancel("consumer", false), "Cancelling twice must fail.")
+
+	_, ok := <-dc
+	assert.False(t, ok, "Delivery channel must be closed when cancelled.")
+
+	assert.Nil(t, d.Ack(false), "Deliveries remain unacked after cancelling.")
+
+	ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte("second")})
+
+	dc, _ = ch.Consume("test", "", true, false, false, false, nil)
+	assert.Equal(t, "second", string(receiveDelivery(t, dc).Body))
+}